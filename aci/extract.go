@@ -0,0 +1,226 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aci
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// mknod creates a device node or a FIFO; it is only set on platforms
+// supporting it.
+var mknod func(path string, hdr *tar.Header) error
+
+// ExtractTar extracts the entries of the given tar archive into dir,
+// keeping the archive layout (the manifest and the rootfs/ directory of an
+// ACI). If cb is not nil, only the entries for which it returns true are
+// extracted.
+//
+// Entries are not allowed to escape dir, either through their name, the
+// target of a hard link or a symlink in their parent directories. Hard links
+// are created to files of dir, so their target must already exist there.
+// Owners are only restored when running as root.
+func ExtractTar(tr *tar.Reader, dir string, cb TarHeaderWalkFunc) error {
+	x := NewExtractor(dir)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading tar entry: %v", err)
+		}
+		if cb != nil && !cb(hdr) {
+			continue
+		}
+		if err := x.ExtractEntry(hdr, tr); err != nil {
+			return err
+		}
+	}
+	return x.Finish()
+}
+
+// An Extractor creates the files described by tar headers under a directory.
+// Finish must be called once all the entries are extracted.
+type Extractor struct {
+	dir   string
+	chown bool
+	// dirs are the extracted directories, whose mode and modification
+	// time are only set by Finish so that their contents can be written.
+	dirs []*extractedDir
+}
+
+type extractedDir struct {
+	path    string
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// NewExtractor returns an Extractor writing into dir.
+func NewExtractor(dir string) *Extractor {
+	return &Extractor{
+		dir:   filepath.Clean(dir),
+		chown: os.Geteuid() == 0,
+	}
+}
+
+// ExtractEntry creates the file described by hdr, reading the contents of
+// regular files from r.
+func (x *Extractor) ExtractEntry(hdr *tar.Header, r io.Reader) error {
+	name, err := x.path(hdr.Name)
+	if err != nil {
+		return err
+	}
+	if name == x.dir {
+		return nil
+	}
+	if err := x.checkParents(name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(name)
+	switch {
+	case err == nil && fi.IsDir() && hdr.Typeflag == tar.TypeDir:
+		// keep the existing directory, only its metadata is updated
+	case err == nil:
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("error extracting %q: %v", hdr.Name, err)
+		}
+	case tar.TypeDir:
+		if err := os.Mkdir(name, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+		x.dirs = append(x.dirs, &extractedDir{name, fileMode(hdr), hdr.ModTime})
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, name); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		target, err := x.path(hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		if err := x.checkParents(target); err != nil {
+			return err
+		}
+		if err := os.Link(target, name); err != nil {
+			return err
+		}
+		// the metadata are the ones of the target
+		return nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if mknod == nil {
+			return fmt.Errorf("cannot extract %q: device nodes are not supported on this platform", hdr.Name)
+		}
+		if err := mknod(name, hdr); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("cannot extract %q: unsupported tar entry type %q", hdr.Name, hdr.Typeflag)
+	}
+
+	if x.chown {
+		if err := os.Lchown(name, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+	if err := os.Chmod(name, fileMode(hdr)); err != nil {
+		return err
+	}
+	return os.Chtimes(name, hdr.ModTime, hdr.ModTime)
+}
+
+// Finish sets the mode and modification time of the extracted directories,
+// deepest first.
+func (x *Extractor) Finish() error {
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		d := x.dirs[i]
+		if err := os.Chmod(d.path, d.mode); err != nil {
+			return err
+		}
+		if err := os.Chtimes(d.path, d.modTime, d.modTime); err != nil {
+			return err
+		}
+	}
+	x.dirs = nil
+	return nil
+}
+
+// path returns the path of the given entry name in the destination
+// directory, failing if it would be outside of it.
+func (x *Extractor) path(name string) (string, error) {
+	clean := filepath.Clean(name)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("tar entry %q is outside of the destination directory", name)
+	}
+	return filepath.Join(x.dir, clean), nil
+}
+
+func fileMode(hdr *tar.Header) os.FileMode {
+	return hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+// checkParents fails if one of the parent directories of p in the
+// destination directory is a symlink, which could be used to write outside
+// of it.
+func (x *Extractor) checkParents(p string) error {
+	rel, err := filepath.Rel(x.dir, filepath.Dir(p))
+	if err != nil || rel == "." {
+		return err
+	}
+	cur := x.dir
+	for _, c := range strings.Split(rel, string(filepath.Separator)) {
+		cur = filepath.Join(cur, c)
+		fi, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("cannot extract %q: parent %q is a symlink", p, cur)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aci
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testEntry struct {
+	hdr      *tar.Header
+	contents string
+}
+
+func newTestTar(entries []testEntry) (*tar.Reader, error) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		if e.hdr.Typeflag == tar.TypeReg {
+			e.hdr.Size = int64(len(e.contents))
+		}
+		if e.hdr.Mode == 0 {
+			e.hdr.Mode = 0644
+		}
+		if err := tw.WriteHeader(e.hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write([]byte(e.contents)); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return tar.NewReader(buf), nil
+}
+
+func TestExtractTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("error creating tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tr, err := newTestTar([]testEntry{
+		{&tar.Header{Name: "manifest", Typeflag: tar.TypeReg}, "{}"},
+		{&tar.Header{Name: "rootfs", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{&tar.Header{Name: "rootfs/ro", Typeflag: tar.TypeDir, Mode: 0555}, ""},
+		{&tar.Header{Name: "rootfs/ro/file", Typeflag: tar.TypeReg, Mode: 0600}, "hello"},
+		{&tar.Header{Name: "rootfs/link", Typeflag: tar.TypeLink, Linkname: "rootfs/ro/file"}, ""},
+		{&tar.Header{Name: "rootfs/symlink", Typeflag: tar.TypeSymlink, Linkname: "ro/file"}, ""},
+		{&tar.Header{Name: "rootfs/skipped", Typeflag: tar.TypeReg}, "skipped"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = ExtractTar(tr, dir, func(hdr *tar.Header) bool {
+		return hdr.Name != "rootfs/skipped"
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// let the directory be removed
+	defer os.Chmod(filepath.Join(dir, "rootfs/ro"), 0755)
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "rootfs/link"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("rootfs/link: got %q, want %q", b, "hello")
+	}
+	fi1, err := os.Stat(filepath.Join(dir, "rootfs/ro/file"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fi1.Mode().Perm() != 0600 {
+		t.Errorf("rootfs/ro/file: got mode %v, want %v", fi1.Mode().Perm(), os.FileMode(0600))
+	}
+	fi2, err := os.Stat(filepath.Join(dir, "rootfs/link"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !os.SameFile(fi1, fi2) {
+		t.Errorf("rootfs/link is not a hard link to rootfs/ro/file")
+	}
+	fi, err := os.Stat(filepath.Join(dir, "rootfs/ro"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fi.Mode().Perm() != 0555 {
+		t.Errorf("rootfs/ro: got mode %v, want %v", fi.Mode().Perm(), os.FileMode(0555))
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "rootfs/symlink")); err != nil || target != "ro/file" {
+		t.Errorf("rootfs/symlink: got %q (%v), want %q", target, err, "ro/file")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "rootfs/skipped")); !os.IsNotExist(err) {
+		t.Errorf("rootfs/skipped should not be extracted")
+	}
+}
+
+func TestExtractTarOutsideDir(t *testing.T) {
+	tests := [][]testEntry{
+		{
+			{&tar.Header{Name: "../evil", Typeflag: tar.TypeReg}, "evil"},
+		},
+		{
+			{&tar.Header{Name: "/evil", Typeflag: tar.TypeReg}, "evil"},
+		},
+		{
+			{&tar.Header{Name: "rootfs/link", Typeflag: tar.TypeLink, Linkname: "../evil"}, ""},
+		},
+		{
+			{&tar.Header{Name: "rootfs/dir", Typeflag: tar.TypeSymlink, Linkname: "/tmp"}, ""},
+			{&tar.Header{Name: "rootfs/dir/evil", Typeflag: tar.TypeReg}, "evil"},
+		},
+	}
+	for i, tt := range tests {
+		dir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatalf("error creating tempdir: %v", err)
+		}
+		tr, err := newTestTar(tt)
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if err := ExtractTar(tr, dir, nil); err == nil {
+			t.Errorf("#%d: expected an error", i)
+		}
+		os.RemoveAll(dir)
+	}
+}
@@ -61,10 +61,17 @@ func init() {
 	out.Init(os.Stdout, 0, 8, 1, '\t', 0)
 	commands = []*Command{
 		cmdBuild,
+		cmdCat,
 		cmdCatManifest,
+		cmdDiff,
+		cmdDiffManifest,
 		cmdDiscover,
+		cmdExtract,
+		cmdFlatten,
 		cmdHelp,
+		cmdLs,
 		cmdPatchManifest,
+		cmdRender,
 		cmdValidate,
 		cmdVersion,
 	}
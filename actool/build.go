@@ -30,14 +30,18 @@ var (
 	buildNocompress bool
 	buildOverwrite  bool
 	buildOwnerRoot  bool
+	buildPinDeps    string
 	cmdBuild        = &Command{
 		Name: "build",
 		Description: `Build an ACI from a given directory. The directory should
 contain an Image Layout. The Image Layout will be validated
 before the ACI is created. The produced ACI will be
-gzip-compressed by default.`,
+gzip-compressed by default.
+
+With --pin-dependencies, the image ID and the size of every
+dependency are set from the matching ACI of the given directory.`,
 		Summary: "Build an ACI from an Image Layout (experimental)",
-		Usage:   `[--overwrite] [--no-compression] [--owner-root] DIRECTORY OUTPUT_FILE`,
+		Usage:   `[--overwrite] [--no-compression] [--owner-root] [--pin-dependencies=DIR] DIRECTORY OUTPUT_FILE`,
 		Run:     runBuild,
 	}
 )
@@ -46,6 +50,7 @@ func init() {
 	cmdBuild.Flags.BoolVar(&buildOverwrite, "overwrite", false, "Overwrite target file if it already exists")
 	cmdBuild.Flags.BoolVar(&buildOwnerRoot, "owner-root", false, "Force ownership to root:root on all files")
 	cmdBuild.Flags.BoolVar(&buildNocompress, "no-compression", false, "Do not gzip-compress the produced ACI")
+	cmdBuild.Flags.StringVar(&buildPinDeps, "pin-dependencies", "", "Directory of ACIs to set the image ID and size of the dependencies from")
 }
 
 func runBuild(args []string) (exit int) {
@@ -118,6 +123,17 @@ func runBuild(args []string) (exit int) {
 		stderr("build: Unable to load Image Manifest: %v", err)
 		return 1
 	}
+	if buildPinDeps != "" {
+		ds, err := newDirStore(buildPinDeps)
+		if err != nil {
+			stderr("build: Unable to load store: %v", err)
+			return 1
+		}
+		if err := ds.pinDependencies(im.Dependencies); err != nil {
+			stderr("build: Unable to pin dependencies: %v", err)
+			return 1
+		}
+	}
 	iw := aci.NewImageWriter(im, tr)
 
 	var walkerCb aci.TarHeaderWalkFunc
@@ -0,0 +1,287 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/pkg/acirenderer"
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+var (
+	diffJSON  bool
+	diffStore string
+	cmdDiff   = &Command{
+		Name: "diff",
+		Description: `Compare two ACIs: their image manifests and the files of their
+rootfs (type, content, mode, owner and link target). If --store
+is given, the dependencies of both images are looked up in the
+ACIs contained in the store directory and the rendered rootfs
+are compared instead.`,
+		Summary: "Show the differences between two ACIs",
+		Usage:   "[--store=DIR] [--json] A_ACI_FILE B_ACI_FILE",
+		Run:     runDiff,
+	}
+
+	diffManifestJSON bool
+	cmdDiffManifest  = &Command{
+		Name: "diff-manifest",
+		Description: `Compare two manifests field by field. Each argument can be an
+image manifest, a pod manifest or an ACI, in which case its
+image manifest is compared. Labels, annotations, isolators and
+the other named lists are compared as sets.`,
+		Summary: "Show the semantic differences between two manifests",
+		Usage:   "[--json] A B",
+		Run:     runDiffManifest,
+	}
+)
+
+func init() {
+	cmdDiff.Flags.BoolVar(&diffJSON, "json", false, "Output the differences as JSON")
+	cmdDiff.Flags.StringVar(&diffStore, "store", "", "Directory of ACIs to render dependencies from")
+
+	cmdDiffManifest.Flags.BoolVar(&diffManifestJSON, "json", false, "Output the differences as JSON")
+}
+
+func runDiff(args []string) (exit int) {
+	if len(args) != 2 {
+		stderr("diff: Must provide two ACI files")
+		return 1
+	}
+
+	var ds *dirStore
+	if diffStore != "" {
+		var err error
+		ds, err = newDirStore(diffStore)
+		if err != nil {
+			stderr("diff: Unable to open store: %v", err)
+			return 1
+		}
+	}
+
+	ims := make([]*schema.ImageManifest, 2)
+	trees := make([]acirenderer.FileTree, 2)
+	for i, path := range args {
+		var err error
+		ims[i], trees[i], err = readACITree(path, ds)
+		if err != nil {
+			stderr("diff: %s: %v", path, err)
+			return 1
+		}
+	}
+
+	manifestDiff := schema.DiffImageManifests(ims[0], ims[1])
+	treeDiff := acirenderer.DiffTrees(trees[0], trees[1])
+	added, removed, modified := treeDiff.Summary()
+
+	if diffJSON {
+		type summary struct {
+			Added    int `json:"added"`
+			Removed  int `json:"removed"`
+			Modified int `json:"modified"`
+		}
+		type aciDiff struct {
+			Manifest schema.ManifestDiff  `json:"manifest"`
+			Summary  summary              `json:"summary"`
+			Files    acirenderer.TreeDiff `json:"files"`
+		}
+		d := aciDiff{
+			Manifest: manifestDiff,
+			Summary:  summary{added, removed, modified},
+			Files:    treeDiff,
+		}
+		if d.Manifest == nil {
+			d.Manifest = schema.ManifestDiff{}
+		}
+		if d.Files == nil {
+			d.Files = acirenderer.TreeDiff{}
+		}
+		out, err := json.MarshalIndent(d, "", "    ")
+		if err != nil {
+			stderr("diff: Error generating JSON: %v", err)
+			return 1
+		}
+		fmt.Println(string(out))
+		return
+	}
+
+	fmt.Printf("manifest: %d changes\n", len(manifestDiff))
+	fmt.Printf("files: %d added, %d removed, %d modified\n", added, removed, modified)
+	if len(manifestDiff) > 0 {
+		fmt.Println("\nmanifest changes:")
+		for _, c := range manifestDiff {
+			fmt.Println(c)
+		}
+	}
+	if len(treeDiff) > 0 {
+		fmt.Println("\nfile changes:")
+		for _, c := range treeDiff {
+			fmt.Println(c)
+		}
+	}
+	return
+}
+
+// readACITree returns the image manifest and the file tree of the given ACI.
+// If ds is not nil, the tree is the rendered tree of the image and its
+// dependencies found in ds.
+func readACITree(path string, ds *dirStore) (*schema.ImageManifest, acirenderer.FileTree, error) {
+	if ds != nil {
+		key, err := ds.add(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		im, err := ds.GetImageManifest(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		h, err := types.NewHash(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		renderedACI, err := acirenderer.GetRenderedACIWithImageID(*h, ds)
+		if err != nil {
+			return nil, nil, err
+		}
+		tree, err := acirenderer.GetRenderedTree(renderedACI, ds)
+		if err != nil {
+			return nil, nil, err
+		}
+		return im, tree, nil
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fh.Close()
+	im, err := aci.ManifestFromImage(fh)
+	if err != nil {
+		return nil, nil, err
+	}
+	tr, err := aci.NewCompressedTarReader(fh)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tr.Close()
+	tree, err := acirenderer.ScanTree(tr.Reader, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return im, tree, nil
+}
+
+func runDiffManifest(args []string) (exit int) {
+	if len(args) != 2 {
+		stderr("diff-manifest: Must provide two files")
+		return 1
+	}
+
+	ka, a, err := readManifestFile(args[0])
+	if err != nil {
+		stderr("diff-manifest: %s: %v", args[0], err)
+		return 1
+	}
+	kb, b, err := readManifestFile(args[1])
+	if err != nil {
+		stderr("diff-manifest: %s: %v", args[1], err)
+		return 1
+	}
+	if ka != kb {
+		stderr("diff-manifest: Cannot compare a %s with a %s", ka, kb)
+		return 1
+	}
+
+	var diff schema.ManifestDiff
+	switch ka {
+	case schema.ImageManifestKind:
+		diff = schema.DiffImageManifests(a.(*schema.ImageManifest), b.(*schema.ImageManifest))
+	case schema.PodManifestKind:
+		diff = schema.DiffPodManifests(a.(*schema.PodManifest), b.(*schema.PodManifest))
+	}
+
+	if diffManifestJSON {
+		if diff == nil {
+			diff = schema.ManifestDiff{}
+		}
+		out, err := json.MarshalIndent(diff, "", "    ")
+		if err != nil {
+			stderr("diff-manifest: Error generating JSON: %v", err)
+			return 1
+		}
+		fmt.Println(string(out))
+		return
+	}
+	for _, c := range diff {
+		fmt.Println(c)
+	}
+	return
+}
+
+// readManifestFile reads an image or pod manifest from the given file, which
+// can also be an ACI.
+func readManifestFile(path string) (types.ACKind, interface{}, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer fh.Close()
+
+	vt, err := detectValType(fh)
+	if err != nil {
+		return "", nil, err
+	}
+	switch vt {
+	case typeAppImage:
+		im, err := aci.ManifestFromImage(fh)
+		if err != nil {
+			return "", nil, err
+		}
+		return schema.ImageManifestKind, im, nil
+	case typeManifest:
+		b, err := ioutil.ReadAll(fh)
+		if err != nil {
+			return "", nil, err
+		}
+		k := schema.Kind{}
+		if err := k.UnmarshalJSON(b); err != nil {
+			return "", nil, err
+		}
+		switch k.ACKind {
+		case schema.ImageManifestKind:
+			im := &schema.ImageManifest{}
+			if err := im.UnmarshalJSON(b); err != nil {
+				return "", nil, err
+			}
+			return k.ACKind, im, nil
+		case schema.PodManifestKind:
+			pm := &schema.PodManifest{}
+			if err := pm.UnmarshalJSON(b); err != nil {
+				return "", nil, err
+			}
+			return k.ACKind, pm, nil
+		default:
+			return "", nil, fmt.Errorf("unknown manifest kind %q", k.ACKind)
+		}
+	default:
+		return "", nil, fmt.Errorf("unable to detect file type")
+	}
+}
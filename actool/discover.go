@@ -15,8 +15,12 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
+	"os"
 	"runtime"
 	"strings"
 
@@ -29,10 +33,17 @@ var (
 		Name:        "discover",
 		Description: "Discover the download URLs for an app",
 		Summary:     "Discover the download URLs for one or more app container images",
-		Usage:       "[--json] [--port] [--insecure] APP...",
+		Usage:       "[--json] [--port] [--insecure] [--base-url URL] [--well-known] [--mirror-config FILE] [--auth-config FILE] [--ca-file FILE] [--cert FILE --key FILE] APP...",
 		Run:         runDiscover,
 	}
-	flagPort uint
+	flagPort         uint
+	flagBaseURL      string
+	flagWellKnown    bool
+	flagMirrorConfig string
+	flagAuthConfig   string
+	flagCAFile       string
+	flagCert         string
+	flagKey          string
 )
 
 func init() {
@@ -42,6 +53,20 @@ func init() {
 		"Output result as JSON")
 	cmdDiscover.Flags.UintVar(&flagPort, "port", 0,
 		"Port to connect to when performing discovery")
+	cmdDiscover.Flags.StringVar(&flagBaseURL, "base-url", "",
+		"Discover from a mirror of the discovery sites at this URL or local directory")
+	cmdDiscover.Flags.BoolVar(&flagWellKnown, "well-known", false,
+		"Try the JSON discovery document at /.well-known/ac-discovery.json of the hosts first")
+	cmdDiscover.Flags.StringVar(&flagMirrorConfig, "mirror-config", "",
+		"JSON file of rules redirecting the discovery of some images to mirrors")
+	cmdDiscover.Flags.StringVar(&flagAuthConfig, "auth-config", "",
+		"JSON file configuring the credentials of the discovery hosts")
+	cmdDiscover.Flags.StringVar(&flagCAFile, "ca-file", "",
+		"PEM file of CA certificates trusted in addition to the system ones")
+	cmdDiscover.Flags.StringVar(&flagCert, "cert", "",
+		"PEM file of the client certificate to present to the discovery hosts")
+	cmdDiscover.Flags.StringVar(&flagKey, "key", "",
+		"PEM file of the private key of the client certificate")
 }
 
 func runDiscover(args []string) (exit int) {
@@ -49,6 +74,36 @@ func runDiscover(args []string) (exit int) {
 		stderr("discover: at least one name required")
 	}
 
+	var mirrors []discovery.MirrorRule
+	if flagMirrorConfig != "" {
+		var err error
+		if mirrors, err = discovery.LoadMirrorRules(flagMirrorConfig); err != nil {
+			stderr("discover: %s", err)
+			return 1
+		}
+	}
+
+	var creds discovery.CredentialProvider
+	if flagAuthConfig != "" {
+		var err error
+		if creds, err = discovery.LoadAuthConfig(flagAuthConfig); err != nil {
+			stderr("discover: %s", err)
+			return 1
+		}
+	}
+
+	hostTLS, err := discoverTLS()
+	if err != nil {
+		stderr("discover: %s", err)
+		return 1
+	}
+
+	// keep stdout for the JSON output
+	var diag io.Writer = os.Stdout
+	if outputJson {
+		diag = os.Stderr
+	}
+
 	for _, name := range args {
 		app, err := discovery.NewAppFromString(name)
 		if app.Labels["os"] == "" {
@@ -65,30 +120,37 @@ func runDiscover(args []string) (exit int) {
 		if transportFlags.Insecure {
 			insecure = discovery.InsecureTLS | discovery.InsecureHTTP
 		}
-		eps, attempts, err := discovery.DiscoverACIEndpoints(*app, nil, insecure, flagPort)
+		d := &discovery.Discoverer{
+			Insecure:    insecure,
+			Port:        flagPort,
+			BaseURL:     flagBaseURL,
+			WellKnown:   flagWellKnown,
+			Mirrors:     mirrors,
+			Credentials: creds,
+			HostTLS:     hostTLS,
+		}
+		eps, warnings, attempts, err := d.DiscoverACIEndpointsWithWarnings(context.Background(), *app)
+		printAttempts(diag, "endpoints", attempts)
 		if err != nil {
+			printWarnings(diag, warnings)
 			stderr("error fetching endpoints for %s: %s", name, err)
 			return 1
 		}
-		for _, a := range attempts {
-			fmt.Printf("discover endpoints walk: prefix: %s error: %v\n", a.Prefix, a.Error)
-		}
-		publicKeys, attempts, err := discovery.DiscoverPublicKeys(*app, nil, insecure, flagPort)
+		publicKeys, attempts, err := d.DiscoverPublicKeys(context.Background(), *app)
+		printAttempts(diag, "public keys", attempts)
 		if err != nil {
 			stderr("error fetching public keys for %s: %s", name, err)
 			return 1
 		}
-		for _, a := range attempts {
-			fmt.Printf("discover public keys walk: prefix: %s error: %v\n", a.Prefix, a.Error)
-		}
 
 		type discoveryData struct {
 			ACIEndpoints []discovery.ACIEndpoint
 			PublicKeys   []string
+			Warnings     []discovery.TemplateWarning `json:",omitempty"`
 		}
 
 		if outputJson {
-			dd := discoveryData{ACIEndpoints: eps, PublicKeys: publicKeys}
+			dd := discoveryData{ACIEndpoints: eps, PublicKeys: publicKeys, Warnings: warnings}
 			jsonBytes, err := json.MarshalIndent(dd, "", "    ")
 			if err != nil {
 				stderr("error generating JSON: %s", err)
@@ -96,6 +158,7 @@ func runDiscover(args []string) (exit int) {
 			}
 			fmt.Println(string(jsonBytes))
 		} else {
+			printWarnings(diag, warnings)
 			for _, aciEndpoint := range eps {
 				fmt.Printf("ACI: %s, ASC: %s\n", aciEndpoint.ACI, aciEndpoint.ASC)
 			}
@@ -107,3 +170,63 @@ func runDiscover(args []string) (exit int) {
 
 	return
 }
+
+// discoverTLS returns the TLS configuration of all the hosts given by the
+// flags, or nil if there is none.
+func discoverTLS() (map[string]*discovery.HostTLSConfig, error) {
+	if (flagCert == "") != (flagKey == "") {
+		return nil, fmt.Errorf("--cert and --key must be given together")
+	}
+	if flagCAFile == "" && flagCert == "" {
+		return nil, nil
+	}
+	hc := &discovery.HostTLSConfig{}
+	if flagCAFile != "" {
+		cas, err := discovery.LoadCertificates(flagCAFile)
+		if err != nil {
+			return nil, err
+		}
+		hc.RootCAs = cas
+	}
+	if flagCert != "" {
+		cert, err := tls.LoadX509KeyPair(flagCert, flagKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading the client certificate: %v", err)
+		}
+		hc.Certificates = []tls.Certificate{cert}
+	}
+	return map[string]*discovery.HostTLSConfig{"*": hc}, nil
+}
+
+func printAttempts(w io.Writer, what string, attempts []discovery.FailedAttempt) {
+	for _, a := range attempts {
+		prefix := fmt.Sprintf("discover %s walk: prefix: %s", what, a.Prefix)
+		if a.Mirror != "" {
+			prefix += " mirror rule: " + a.Mirror
+		}
+		if len(a.Failures) == 0 {
+			fmt.Fprintf(w, "%s reason: %s error: %v\n", prefix, a.Reason, a.Error)
+			continue
+		}
+		for _, f := range a.Failures {
+			msg := prefix + " url: " + f.URL
+			if f.FallbackFrom != "" {
+				msg += " fallback from: " + f.FallbackFrom
+			}
+			fmt.Fprintf(w, "%s reason: %s error: %v\n", msg, f.Reason, f.Err)
+		}
+	}
+}
+
+func printWarnings(w io.Writer, warnings []discovery.TemplateWarning) {
+	for _, tw := range warnings {
+		fmt.Fprintf(w, "discover endpoints warning: prefix: %s template: %s", tw.Prefix, tw.Template)
+		if len(tw.Missing) != 0 {
+			fmt.Fprintf(w, " missing: %s", strings.Join(tw.Missing, ","))
+		}
+		if len(tw.Unused) != 0 {
+			fmt.Fprintf(w, " unused: %s", strings.Join(tw.Unused, ","))
+		}
+		fmt.Fprintln(w)
+	}
+}
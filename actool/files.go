@@ -0,0 +1,241 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/appc/spec/aci"
+)
+
+var (
+	lsLong bool
+	cmdLs  = &Command{
+		Name: "ls",
+		Description: `List the files of the rootfs of an ACI. If PATH is given, only
+PATH and, if it is a directory, its contents are listed.`,
+		Summary: "List the files of an ACI",
+		Usage:   "[--long] ACI_FILE [PATH]",
+		Run:     runLs,
+	}
+
+	cmdCat = &Command{
+		Name:        "cat",
+		Description: `Print the contents of a file of the rootfs of an ACI.`,
+		Summary:     "Print a file of an ACI",
+		Usage:       "ACI_FILE PATH",
+		Run:         runCat,
+	}
+
+	cmdExtract = &Command{
+		Name: "extract",
+		Description: `Extract an ACI into a directory, keeping its layout (the manifest
+and the rootfs directory). If PATHs are given, only these files
+of the rootfs and, for directories, their contents are extracted.
+Owners are only restored when running as root.`,
+		Summary: "Extract the files of an ACI",
+		Usage:   "ACI_FILE DIRECTORY [PATH...]",
+		Run:     runExtract,
+	}
+
+	errFileNotFound = errors.New("no such file in the image")
+)
+
+func init() {
+	cmdLs.Flags.BoolVar(&lsLong, "long", false, "Print the mode, owner, size and modification time of the files")
+}
+
+func runLs(args []string) (exit int) {
+	if len(args) < 1 || len(args) > 2 {
+		stderr("ls: Must provide an ACI file and optionally a path")
+		return 1
+	}
+	root := aci.RootfsDir
+	if len(args) == 2 {
+		root = rootfsPath(args[1])
+	}
+
+	found := false
+	err := walkACI(args[0], func(tr *tar.Reader, hdr *tar.Header) error {
+		name := filepath.Clean(hdr.Name)
+		if !inTree(root, name) {
+			return nil
+		}
+		found = true
+		if name == aci.RootfsDir {
+			return nil
+		}
+		p := imagePath(name)
+		if !lsLong {
+			fmt.Println(p)
+			return nil
+		}
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			p += " -> " + hdr.Linkname
+		case tar.TypeLink:
+			p += " link to " + imagePath(filepath.Clean(hdr.Linkname))
+		}
+		fmt.Printf("%s %5d %5d %10d %s %s\n", hdr.FileInfo().Mode(), hdr.Uid, hdr.Gid, hdr.Size, hdr.ModTime.Format("2006-01-02 15:04"), p)
+		return nil
+	})
+	if err == nil && !found && len(args) == 2 {
+		err = fmt.Errorf("%s: %v", args[1], errFileNotFound)
+	}
+	if err != nil {
+		stderr("ls: %v", err)
+		return 1
+	}
+	return
+}
+
+func runCat(args []string) (exit int) {
+	if len(args) != 2 {
+		stderr("cat: Must provide an ACI file and a path")
+		return 1
+	}
+
+	// Hard links are resolved by reading the image again, as their target
+	// has already been read when the link is found.
+	name := rootfsPath(args[1])
+	for seen := map[string]bool{}; !seen[name]; {
+		seen[name] = true
+		var link string
+		found := false
+		err := walkACI(args[0], func(tr *tar.Reader, hdr *tar.Header) error {
+			if found || filepath.Clean(hdr.Name) != name {
+				return nil
+			}
+			found = true
+			switch hdr.Typeflag {
+			case tar.TypeReg, tar.TypeRegA:
+				_, err := io.Copy(os.Stdout, tr)
+				return err
+			case tar.TypeLink:
+				link = filepath.Clean(hdr.Linkname)
+				return nil
+			case tar.TypeSymlink:
+				return fmt.Errorf("is a symlink to %s", hdr.Linkname)
+			case tar.TypeDir:
+				return errors.New("is a directory")
+			default:
+				return errors.New("is not a regular file")
+			}
+		})
+		if err == nil && !found {
+			err = errFileNotFound
+		}
+		if err != nil {
+			stderr("cat: %s: %v", args[1], err)
+			return 1
+		}
+		if link == "" {
+			return
+		}
+		name = link
+	}
+	stderr("cat: %s: hard link loop", args[1])
+	return 1
+}
+
+func runExtract(args []string) (exit int) {
+	if len(args) < 2 {
+		stderr("extract: Must provide an ACI file and a directory")
+		return 1
+	}
+	var roots []string
+	for _, p := range args[2:] {
+		roots = append(roots, rootfsPath(p))
+	}
+
+	if err := os.MkdirAll(args[1], 0755); err != nil {
+		stderr("extract: %v", err)
+		return 1
+	}
+	x := aci.NewExtractor(args[1])
+	err := walkACI(args[0], func(tr *tar.Reader, hdr *tar.Header) error {
+		if len(roots) > 0 {
+			name := filepath.Clean(hdr.Name)
+			selected := false
+			for _, root := range roots {
+				if inTree(root, name) {
+					selected = true
+					break
+				}
+			}
+			if !selected {
+				return nil
+			}
+		}
+		return x.ExtractEntry(hdr, tr)
+	})
+	if err == nil {
+		err = x.Finish()
+	}
+	if err != nil {
+		stderr("extract: %v", err)
+		return 1
+	}
+	return
+}
+
+// walkACI calls walkFunc for each entry of the given ACI file, whatever its
+// compression.
+func walkACI(path string, walkFunc func(tr *tar.Reader, hdr *tar.Header) error) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	tr, err := aci.NewCompressedTarReader(fh)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading tar entry: %v", err)
+		}
+		if err := walkFunc(tr.Reader, hdr); err != nil {
+			return err
+		}
+	}
+}
+
+// rootfsPath returns the name in the archive of the given path of the
+// image filesystem.
+func rootfsPath(p string) string {
+	return filepath.Join(aci.RootfsDir, filepath.Clean("/"+p))
+}
+
+// imagePath is the inverse of rootfsPath.
+func imagePath(name string) string {
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(name, aci.RootfsDir), "/")
+}
+
+// inTree returns whether name is root or one of its descendants.
+func inTree(root, name string) bool {
+	return name == root || strings.HasPrefix(name, root+"/")
+}
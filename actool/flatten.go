@@ -0,0 +1,107 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/appc/spec/pkg/acirenderer"
+	"github.com/appc/spec/schema"
+)
+
+var (
+	flattenNocompress bool
+	flattenOverwrite  bool
+	flattenStore      string
+	cmdFlatten        = &Command{
+		Name: "flatten",
+		Description: `Render an ACI and its dependencies into a new ACI without
+dependencies. Dependencies are looked up in the ACIs contained
+in the store directory. The produced ACI will be
+gzip-compressed by default.`,
+		Summary: "Merge an ACI and its dependencies into a single ACI",
+		Usage:   "[--store=DIR] [--overwrite] [--no-compression] INPUT_ACI_FILE OUTPUT_ACI_FILE",
+		Run:     runFlatten,
+	}
+)
+
+func init() {
+	cmdFlatten.Flags.StringVar(&flattenStore, "store", "", "Directory of ACIs to render dependencies from")
+	cmdFlatten.Flags.BoolVar(&flattenOverwrite, "overwrite", false, "Overwrite target file if it already exists")
+	cmdFlatten.Flags.BoolVar(&flattenNocompress, "no-compression", false, "Do not gzip-compress the produced ACI")
+}
+
+func runFlatten(args []string) (exit int) {
+	if len(args) != 2 {
+		stderr("flatten: Must provide input and output files")
+		return 1
+	}
+
+	tgt := args[1]
+	ext := filepath.Ext(tgt)
+	if ext != schema.ACIExtension {
+		stderr("flatten: Extension must be %s (given %s)", schema.ACIExtension, ext)
+		return 1
+	}
+
+	ds, renderedACI, err := renderACIFile(args[0], flattenStore)
+	if err != nil {
+		stderr("flatten: %s: %v", args[0], err)
+		return 1
+	}
+
+	mode := os.O_CREATE | os.O_WRONLY
+	if flattenOverwrite {
+		mode |= os.O_TRUNC
+	} else {
+		mode |= os.O_EXCL
+	}
+	fh, err := os.OpenFile(tgt, mode, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			stderr("flatten: Target file exists (try --overwrite)")
+		} else {
+			stderr("flatten: Unable to open target %s: %v", tgt, err)
+		}
+		return 1
+	}
+	defer func() {
+		fh.Close()
+		if exit != 0 {
+			os.Remove(tgt)
+		}
+	}()
+
+	var w io.Writer = fh
+	var gw *gzip.Writer
+	if !flattenNocompress {
+		gw = gzip.NewWriter(fh)
+		w = gw
+	}
+	if err := acirenderer.WriteFlattenedTar(renderedACI, ds, w); err != nil {
+		stderr("flatten: %v", err)
+		return 1
+	}
+	if gw != nil {
+		if err := gw.Close(); err != nil {
+			stderr("flatten: Unable to close image %s: %v", tgt, err)
+			return 1
+		}
+	}
+	return
+}
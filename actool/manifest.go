@@ -54,6 +54,7 @@ var (
 	patchIsolators         string
 	patchSeccompMode       string
 	patchSeccompSet        string
+	patchPinDeps           string
 
 	catPrettyPrint bool
 
@@ -74,6 +75,7 @@ var (
 		  [--isolators=resource/cpu,request=50m,limit=100m[:resource/memory,...]]
 		  [--seccomp-mode=remove|retain[,errno=EPERM]]
 		  [--seccomp-set=syscall1,syscall2,...]]
+		  [--pin-dependencies=DIR]
 		  [--replace]
 		  INPUT_ACI_FILE
 		  [OUTPUT_ACI_FILE]`,
@@ -106,6 +108,7 @@ func init() {
 	cmdPatchManifest.Flags.StringVar(&patchIsolators, "isolators", "", "Replace isolators")
 	cmdPatchManifest.Flags.StringVar(&patchSeccompMode, "seccomp-mode", "", "Enable and configure seccomp isolator")
 	cmdPatchManifest.Flags.StringVar(&patchSeccompSet, "seccomp-set", "", "Set of syscalls for seccomp isolator enforcing")
+	cmdPatchManifest.Flags.StringVar(&patchPinDeps, "pin-dependencies", "", "Set the image ID and size of the dependencies from the ACIs of this directory")
 
 	cmdCatManifest.Flags.BoolVar(&catPrettyPrint, "pretty-print", false, "Print with better style")
 }
@@ -301,6 +304,16 @@ func patchManifest(im *schema.ImageManifest) error {
 			app.Isolators = append(app.Isolators, *isolator)
 		}
 	}
+
+	if patchPinDeps != "" {
+		ds, err := newDirStore(patchPinDeps)
+		if err != nil {
+			return err
+		}
+		if err := ds.pinDependencies(im.Dependencies); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -447,7 +460,7 @@ func runPatchManifest(args []string) (exit int) {
 		stderr("patch-manifest: Must provide one file")
 		return 1
 	}
-	if patchManifestFile != "" && (patchName != "" || patchExec != "" || patchUser != "" || patchGroup != "" || patchCaps != "" || patchMounts != "") {
+	if patchManifestFile != "" && (patchName != "" || patchExec != "" || patchUser != "" || patchGroup != "" || patchCaps != "" || patchMounts != "" || patchPinDeps != "") {
 		stderr("patch-manifest: --manifest is incompatible with other manifest editing options")
 		return 1
 	}
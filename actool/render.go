@@ -0,0 +1,157 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/pkg/acirenderer"
+	"github.com/appc/spec/schema/types"
+)
+
+var (
+	renderStore   string
+	renderExplain bool
+	cmdRender     = &Command{
+		Name: "render",
+		Description: `Render an ACI and its dependencies into a directory, using the
+ACI layout. Dependencies are looked up in the ACIs contained in
+the store directory. Owners are only restored when running as
+root.
+
+With --explain, nothing is rendered: for every file of the images,
+the image providing it is printed, followed by the images whose
+copy is dropped and why.`,
+		Summary: "Render an ACI with its dependencies to a directory",
+		Usage:   "[--store=DIR] [--explain] ACI_FILE [DIRECTORY]",
+		Run:     runRender,
+	}
+)
+
+func init() {
+	cmdRender.Flags.StringVar(&renderStore, "store", "", "Directory of ACIs to render dependencies from")
+	cmdRender.Flags.BoolVar(&renderExplain, "explain", false, "Print which image provides each file instead of rendering")
+}
+
+func runRender(args []string) (exit int) {
+	if renderExplain {
+		if len(args) != 1 {
+			stderr("render: Must provide an ACI file")
+			return 1
+		}
+		return explainRender(args[0])
+	}
+	if len(args) != 2 {
+		stderr("render: Must provide an ACI file and a directory")
+		return 1
+	}
+
+	ds, renderedACI, err := renderACIFile(args[0], renderStore)
+	if err != nil {
+		stderr("render: %s: %v", args[0], err)
+		return 1
+	}
+	if err := acirenderer.RenderToDir(renderedACI, ds, args[1]); err != nil {
+		stderr("render: %v", err)
+		return 1
+	}
+	return
+}
+
+func explainRender(path string) (exit int) {
+	ds, imgs, err := depListACIFile(path, renderStore)
+	if err != nil {
+		stderr("render: %s: %v", path, err)
+		return 1
+	}
+	_, prov, err := acirenderer.GetRenderedACIFromListWithProvenance(imgs, ds)
+	if err != nil {
+		stderr("render: %s: %v", path, err)
+		return 1
+	}
+
+	names := make([]string, 0, len(prov))
+	for name := range prov {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fp := prov[name]
+		provider := "not rendered"
+		if fp.Key != "" {
+			provider = describeImage(fp.Name, fp.Key)
+		}
+		fmt.Printf("%s: %s\n", explainPath(name), provider)
+		for _, d := range fp.Dropped {
+			fmt.Printf("    dropped from %s: %s\n", describeImage(d.Name, d.Key), d.Reason)
+		}
+	}
+	return
+}
+
+// explainPath returns the path of a file of the image filesystem, the
+// manifest is kept as is.
+func explainPath(name string) string {
+	if inTree(aci.RootfsDir, name) {
+		return imagePath(name)
+	}
+	return name
+}
+
+// describeImage returns the name of an image with a shortened key.
+func describeImage(name types.ACIdentifier, key string) string {
+	if len(key) > len("sha512-")+12 {
+		key = key[:len("sha512-")+12]
+	}
+	return fmt.Sprintf("%s (%s)", name, key)
+}
+
+// depListACIFile returns the dependency list of the given ACI file, whose
+// dependencies are looked up in storeDir, and the store providing it.
+func depListACIFile(path, storeDir string) (*dirStore, acirenderer.Images, error) {
+	ds, err := newDirStore(storeDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := ds.add(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	h, err := types.NewHash(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	imgs, err := acirenderer.CreateDepListFromImageID(*h, ds)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ds, imgs, nil
+}
+
+// renderACIFile returns the RenderedACI of the given ACI file, whose
+// dependencies are looked up in storeDir, and the store providing it.
+func renderACIFile(path, storeDir string) (*dirStore, acirenderer.RenderedACI, error) {
+	ds, imgs, err := depListACIFile(path, storeDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	renderedACI, err := acirenderer.GetRenderedACIFromList(imgs, ds)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ds, renderedACI, nil
+}
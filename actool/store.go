@@ -0,0 +1,197 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/pkg/acirenderer"
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+// dirStore is an acirenderer.ACIRegistry backed by a directory containing ACI
+// files. Images are keyed by their image ID.
+type dirStore struct {
+	acis map[string]*dirStoreACI
+}
+
+type dirStoreACI struct {
+	path string
+	im   *schema.ImageManifest
+	// size is the size of the uncompressed ACI.
+	size uint64
+}
+
+// newDirStore creates a dirStore containing every ACI found in dir. An empty
+// dir creates an empty store.
+func newDirStore(dir string) (*dirStore, error) {
+	ds := &dirStore{acis: make(map[string]*dirStoreACI)}
+	if dir == "" {
+		return ds, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+schema.ACIExtension))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		if _, err := ds.add(p); err != nil {
+			return nil, fmt.Errorf("%s: %v", p, err)
+		}
+	}
+	return ds, nil
+}
+
+// add adds the ACI at the given path to the store and returns its key.
+func (ds *dirStore) add(path string) (string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	im, err := aci.ManifestFromImage(fh)
+	if err != nil {
+		return "", err
+	}
+	dr, err := aci.NewCompressedReader(fh)
+	if err != nil {
+		return "", err
+	}
+	defer dr.Close()
+	h := sha512.New()
+	n, err := io.Copy(h, dr)
+	if err != nil {
+		return "", err
+	}
+
+	key := ds.HashToKey(h)
+	ds.acis[key] = &dirStoreACI{path: path, im: im, size: uint64(n)}
+	return key, nil
+}
+
+func (ds *dirStore) GetImageManifest(key string) (*schema.ImageManifest, error) {
+	a, ok := ds.acis[key]
+	if !ok {
+		return nil, fmt.Errorf("image %s not found", key)
+	}
+	return a.im, nil
+}
+
+// GetACI returns the key of the image matching the given name and labels,
+// as a dependency with no image ID, using the os and arch of the host as
+// default labels.
+func (ds *dirStore) GetACI(name types.ACIdentifier, labels types.Labels) (string, error) {
+	m, err := acirenderer.NewDependencyMatcher()
+	if err != nil {
+		return "", err
+	}
+	var candidates []acirenderer.Candidate
+	for key, a := range ds.acis {
+		h, err := types.NewHash(key)
+		if err != nil {
+			return "", err
+		}
+		candidates = append(candidates, acirenderer.Candidate{ImageID: *h, Manifest: a.im})
+	}
+	c, err := m.Match(types.Dependency{ImageName: name, Labels: labels}, candidates)
+	if err != nil {
+		return "", err
+	}
+	return c.ImageID.String(), nil
+}
+
+// pinDependencies sets the image ID and the size of the given dependencies
+// to the ones of the matching images of the store. A dependency with an image
+// ID must be in the store with the same name and, if the dependency already
+// has a size, the same size.
+func (ds *dirStore) pinDependencies(deps types.Dependencies) error {
+	for i := range deps {
+		d := &deps[i]
+		var key string
+		var err error
+		if d.ImageID != nil && !d.ImageID.Empty() {
+			key, err = ds.ResolveKey(d.ImageID.String())
+		} else {
+			key, err = ds.GetACI(d.ImageName, d.Labels)
+		}
+		if err != nil {
+			return fmt.Errorf("dependency %s: %v", d.ImageName, err)
+		}
+		a := ds.acis[key]
+		if !a.im.Name.Equals(d.ImageName) {
+			return fmt.Errorf("dependency %s: image %s is named %s", d.ImageName, key, a.im.Name)
+		}
+		if d.Size != 0 && uint64(d.Size) != a.size {
+			return fmt.Errorf("dependency %s: size %d does not match the size of %s (%d)", d.ImageName, d.Size, key, a.size)
+		}
+		if d.ImageID, err = types.NewHash(key); err != nil {
+			return err
+		}
+		d.Size = uint(a.size)
+	}
+	return nil
+}
+
+// ReadStream returns the uncompressed tar stream of the image.
+func (ds *dirStore) ReadStream(key string) (io.ReadCloser, error) {
+	a, ok := ds.acis[key]
+	if !ok {
+		return nil, fmt.Errorf("image %s not found", key)
+	}
+	return readACI(a.path)
+}
+
+func (ds *dirStore) ResolveKey(key string) (string, error) {
+	if _, ok := ds.acis[key]; !ok {
+		return "", fmt.Errorf("image %s not found", key)
+	}
+	return key, nil
+}
+
+func (ds *dirStore) HashToKey(h hash.Hash) string {
+	return fmt.Sprintf("sha512-%x", h.Sum(nil))
+}
+
+// aciReader closes both the decompressing reader and the underlying file.
+type aciReader struct {
+	io.ReadCloser
+	fh *os.File
+}
+
+func (r *aciReader) Close() error {
+	r.ReadCloser.Close()
+	return r.fh.Close()
+}
+
+// readACI returns the uncompressed tar stream of the ACI at the given path.
+func readACI(path string) (io.ReadCloser, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	dr, err := aci.NewCompressedReader(fh)
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	return &aciReader{dr, fh}, nil
+}
@@ -0,0 +1,384 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"unicode"
+)
+
+// Credentials authenticate the discovery requests to a host.
+type Credentials struct {
+	// User and Password are used for basic authentication.
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Token is used for bearer authentication.
+	Token string `json:"token,omitempty"`
+}
+
+// Challenge is an authentication challenge of a WWW-Authenticate header.
+type Challenge struct {
+	// Scheme is the lower case authentication scheme, e.g. basic.
+	Scheme string
+	// Params are the parameters of the challenge, keyed by their lower case
+	// name, e.g. realm.
+	Params map[string]string
+}
+
+// CredentialProvider provides the credentials of the hosts.
+type CredentialProvider interface {
+	// Credentials returns the credentials for the host, with its port if
+	// any, or nil if it has none. The challenge is nil for the first
+	// request, and the challenge of the 401 Unauthorized response when the
+	// request is retried, allowing for example to get a token for the realm
+	// of a bearer challenge.
+	Credentials(ctx context.Context, host string, ch *Challenge) (*Credentials, error)
+}
+
+// authorization returns the Authorization header value for the scheme of
+// the challenge, or any if ch is nil, the token being preferred. It is empty
+// if the credentials are not usable for the scheme.
+func (c *Credentials) authorization(ch *Challenge) string {
+	scheme := ""
+	if ch != nil {
+		scheme = ch.Scheme
+	}
+	if c.Token != "" && (scheme == "" || scheme == "bearer") {
+		return "Bearer " + c.Token
+	}
+	if c.User != "" && (scheme == "" || scheme == "basic") {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.User+":"+c.Password))
+	}
+	return ""
+}
+
+// StaticCredentials are credentials keyed by host. A host is looked up with
+// its port, then without; the "*" key matches every host.
+type StaticCredentials map[string]Credentials
+
+func (s StaticCredentials) Credentials(ctx context.Context, host string, ch *Challenge) (*Credentials, error) {
+	keys := []string{host}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		keys = append(keys, h)
+	}
+	for _, k := range append(keys, "*") {
+		if c, ok := s[k]; ok {
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+// LoadNetrc reads the credentials of a netrc file. The default entry, if
+// any, matches every host.
+func LoadNetrc(path string) (StaticCredentials, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	creds := make(StaticCredentials)
+	var host string
+	var c *Credentials
+	flush := func() {
+		if c != nil {
+			creds[host] = *c
+		}
+	}
+	lines := strings.Split(string(b), "\n")
+	for i := 0; i < len(lines); i++ {
+		fields := strings.Fields(lines[i])
+		for j := 0; j < len(fields); j++ {
+			next := func() string {
+				if j+1 < len(fields) {
+					j++
+					return fields[j]
+				}
+				return ""
+			}
+			switch fields[j] {
+			case "machine":
+				flush()
+				host, c = next(), &Credentials{}
+			case "default":
+				flush()
+				host, c = "*", &Credentials{}
+			case "login":
+				if v := next(); c != nil {
+					c.User = v
+				}
+			case "password":
+				if v := next(); c != nil {
+					c.Password = v
+				}
+			case "account":
+				next()
+			case "macdef":
+				// a macro definition ends with an empty line
+				for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" {
+					i++
+				}
+				j = len(fields)
+			}
+		}
+	}
+	flush()
+	return creds, nil
+}
+
+// EnvCredentials reads the credentials of a host from the environment
+// variables PREFIX_HOST_USER, PREFIX_HOST_PASSWORD and PREFIX_HOST_TOKEN,
+// where HOST is the upper case host with its port, every other character
+// than letters and digits being replaced by an underscore. For example,
+// with the AC_DISCOVERY prefix, the token of example.com:8443 is read from
+// AC_DISCOVERY_EXAMPLE_COM_8443_TOKEN.
+type EnvCredentials struct {
+	Prefix string
+}
+
+func (e EnvCredentials) Credentials(ctx context.Context, host string, ch *Challenge) (*Credentials, error) {
+	name := strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, host)
+	name = e.Prefix + "_" + name + "_"
+	c := Credentials{
+		User:     os.Getenv(name + "USER"),
+		Password: os.Getenv(name + "PASSWORD"),
+		Token:    os.Getenv(name + "TOKEN"),
+	}
+	if c == (Credentials{}) {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+// HelperCredentials gets the credentials from an external command. The
+// command is run with the host as last argument and the challenge, if any,
+// as JSON on its standard input. It prints the JSON of the credentials, with
+// the user, password and token keys, or nothing if it has none.
+type HelperCredentials struct {
+	Command []string
+}
+
+func (h HelperCredentials) Credentials(ctx context.Context, host string, ch *Challenge) (*Credentials, error) {
+	if len(h.Command) == 0 {
+		return nil, fmt.Errorf("no credential helper command")
+	}
+	cmd := exec.CommandContext(ctx, h.Command[0], append(h.Command[1:], host)...)
+	if ch != nil {
+		b, err := json.Marshal(map[string]interface{}{"scheme": ch.Scheme, "params": ch.Params})
+		if err != nil {
+			return nil, err
+		}
+		cmd.Stdin = bytes.NewReader(b)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("credential helper %s failed: %v: %s", h.Command[0], err, strings.TrimSpace(stderr.String()))
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return nil, nil
+	}
+	var c Credentials
+	if err := json.Unmarshal(out, &c); err != nil {
+		return nil, fmt.Errorf("error parsing the output of credential helper %s: %v", h.Command[0], err)
+	}
+	return &c, nil
+}
+
+// CredentialProviders consults the providers in order, returning the first
+// credentials found.
+type CredentialProviders []CredentialProvider
+
+func (ps CredentialProviders) Credentials(ctx context.Context, host string, ch *Challenge) (*Credentials, error) {
+	for _, p := range ps {
+		c, err := p.Credentials(ctx, host, ch)
+		if err != nil || c != nil {
+			return c, err
+		}
+	}
+	return nil, nil
+}
+
+// AuthConfig is the content of an authentication configuration file.
+type AuthConfig struct {
+	// Hosts are the credentials keyed by host, as StaticCredentials.
+	Hosts StaticCredentials `json:"hosts,omitempty"`
+	// EnvPrefix, if set, reads the credentials from the environment, as
+	// EnvCredentials.
+	EnvPrefix string `json:"envPrefix,omitempty"`
+	// Netrc is the path of a netrc file.
+	Netrc string `json:"netrc,omitempty"`
+	// Helper is the command of a credential helper, as HelperCredentials.
+	Helper []string `json:"helper,omitempty"`
+}
+
+// LoadAuthConfig reads a JSON authentication configuration file and returns
+// the provider consulting, in order, the hosts, the environment, the netrc
+// file and the helper of the configuration. For example:
+//
+//	{
+//	    "hosts": {
+//	        "example.com": {"user": "user", "password": "secret"},
+//	        "registry.example.org:8443": {"token": "token"}
+//	    },
+//	    "envPrefix": "AC_DISCOVERY",
+//	    "netrc": "/home/user/.netrc",
+//	    "helper": ["/usr/local/bin/discovery-credentials", "get"]
+//	}
+func LoadAuthConfig(path string) (CredentialProvider, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c AuthConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("error parsing authentication configuration %s: %v", path, err)
+	}
+	var ps CredentialProviders
+	if len(c.Hosts) != 0 {
+		ps = append(ps, c.Hosts)
+	}
+	if c.EnvPrefix != "" {
+		ps = append(ps, EnvCredentials{Prefix: c.EnvPrefix})
+	}
+	if c.Netrc != "" {
+		netrc, err := LoadNetrc(c.Netrc)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, netrc)
+	}
+	if len(c.Helper) != 0 {
+		ps = append(ps, HelperCredentials{Command: c.Helper})
+	}
+	return ps, nil
+}
+
+// parseChallenges parses the challenges of WWW-Authenticate header values.
+func parseChallenges(values []string) []Challenge {
+	var chs []Challenge
+	for _, v := range values {
+		for v != "" {
+			v = strings.TrimLeft(v, " \t,")
+			tok := v
+			if i := strings.IndexAny(v, " \t,="); i >= 0 {
+				tok = v[:i]
+			}
+			if tok == "" {
+				break
+			}
+			v = strings.TrimLeft(v[len(tok):], " \t")
+			if !strings.HasPrefix(v, "=") || len(chs) == 0 {
+				chs = append(chs, Challenge{Scheme: strings.ToLower(tok), Params: map[string]string{}})
+				continue
+			}
+			// a parameter of the current challenge
+			v = strings.TrimLeft(v[1:], " \t")
+			var value string
+			if strings.HasPrefix(v, `"`) {
+				var b bytes.Buffer
+				i := 1
+				for ; i < len(v) && v[i] != '"'; i++ {
+					if v[i] == '\\' && i+1 < len(v) {
+						i++
+					}
+					b.WriteByte(v[i])
+				}
+				if i < len(v) {
+					// the closing quote
+					i++
+				}
+				value, v = b.String(), v[i:]
+			} else {
+				value = v
+				if i := strings.IndexAny(v, " \t,"); i >= 0 {
+					value = v[:i]
+				}
+				v = v[len(value):]
+			}
+			chs[len(chs)-1].Params[strings.ToLower(tok)] = value
+		}
+	}
+	return chs
+}
+
+// authFetch performs the request with the credentials of its host, if any,
+// retrying it once with the credentials for the challenge of a 401
+// Unauthorized response. Credentials are only sent over HTTPS, and never
+// replace an Authorization header set by the host headers.
+func (d *Discoverer) authFetch(do httpDoer, req *http.Request) (*http.Response, error) {
+	if d.Credentials == nil || req.URL.Scheme != "https" || req.Header.Get("Authorization") != "" {
+		return do.Do(req)
+	}
+	ctx := req.Context()
+	c, err := d.Credentials.Credentials(ctx, req.URL.Host, nil)
+	if err != nil {
+		return nil, err
+	}
+	var auth string
+	if c != nil {
+		auth = c.authorization(nil)
+	}
+	res, err := do.Do(withAuthorization(req, auth))
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+
+	for _, ch := range parseChallenges(res.Header["Www-Authenticate"]) {
+		if ch.Scheme != "basic" && ch.Scheme != "bearer" {
+			continue
+		}
+		ch := ch
+		c, err := d.Credentials.Credentials(ctx, req.URL.Host, &ch)
+		if err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+		if c == nil {
+			continue
+		}
+		if retryAuth := c.authorization(&ch); retryAuth != "" && retryAuth != auth {
+			res.Body.Close()
+			return do.Do(withAuthorization(req, retryAuth))
+		}
+	}
+	return res, nil
+}
+
+// withAuthorization returns a copy of the request with the Authorization
+// header set, or the request itself if auth is empty.
+func withAuthorization(req *http.Request, auth string) *http.Request {
+	if auth == "" {
+		return req
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", auth)
+	return req
+}
@@ -0,0 +1,208 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+)
+
+func TestParseChallenges(t *testing.T) {
+	tests := []struct {
+		values []string
+		chs    []Challenge
+	}{
+		{
+			[]string{`Basic realm="example"`},
+			[]Challenge{{"basic", map[string]string{"realm": "example"}}},
+		},
+		{
+			[]string{`Bearer realm="https://auth.example.com/token",service="example.com", scope=discovery`},
+			[]Challenge{{"bearer", map[string]string{
+				"realm":   "https://auth.example.com/token",
+				"service": "example.com",
+				"scope":   "discovery",
+			}}},
+		},
+		{
+			[]string{`Negotiate, Basic realm="a \"quoted\" realm", charset="UTF-8"`, `Bearer`},
+			[]Challenge{
+				{"negotiate", map[string]string{}},
+				{"basic", map[string]string{"realm": `a "quoted" realm`, "charset": "UTF-8"}},
+				{"bearer", map[string]string{}},
+			},
+		},
+		{
+			[]string{`Basic realm="unterminated`},
+			[]Challenge{{"basic", map[string]string{"realm": "unterminated"}}},
+		},
+		{
+			[]string{""},
+			nil,
+		},
+	}
+	for i, tt := range tests {
+		chs := parseChallenges(tt.values)
+		if !reflect.DeepEqual(chs, tt.chs) {
+			t.Errorf("#%d: got %#v, want %#v", i, chs, tt.chs)
+		}
+	}
+}
+
+func TestCredentialProviders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery-auth")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	netrc := filepath.Join(dir, "netrc")
+	err = ioutil.WriteFile(netrc, []byte(`machine example.com login user password secret
+macdef init
+machine ignored.com
+login ignored
+
+machine example.org:8443
+	login other
+	account unused
+	password pass
+default login anonymous password guest
+`), 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	os.Setenv("AC_DISCOVERY_TEST_ENV_EXAMPLE_COM_8443_TOKEN", "envtoken")
+	defer os.Unsetenv("AC_DISCOVERY_TEST_ENV_EXAMPLE_COM_8443_TOKEN")
+	config := filepath.Join(dir, "auth.json")
+	err = ioutil.WriteFile(config, []byte(fmt.Sprintf(`{
+		"hosts": {"static.example.com": {"token": "static"}},
+		"envPrefix": "AC_DISCOVERY_TEST",
+		"netrc": %q
+	}`, netrc)), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p, err := LoadAuthConfig(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		host  string
+		creds *Credentials
+	}{
+		{"static.example.com", &Credentials{Token: "static"}},
+		{"env.example.com:8443", &Credentials{Token: "envtoken"}},
+		{"example.com", &Credentials{User: "user", Password: "secret"}},
+		{"example.com:443", &Credentials{User: "user", Password: "secret"}},
+		{"example.org:8443", &Credentials{User: "other", Password: "pass"}},
+		{"ignored.com", &Credentials{User: "anonymous", Password: "guest"}},
+	}
+	for i, tt := range tests {
+		creds, err := p.Credentials(context.Background(), tt.host, nil)
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(creds, tt.creds) {
+			t.Errorf("#%d: got credentials %#v for %s, want %#v", i, creds, tt.host, tt.creds)
+		}
+	}
+
+	// the helper answers for bearer challenges only
+	helper := HelperCredentials{Command: []string{"sh", "-c", `grep -q '"scheme":"bearer"' && echo '{"token": "'$1'"}'; true`, "helper"}}
+	creds, err := helper.Credentials(context.Background(), "example.com", &Challenge{"bearer", map[string]string{}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(creds, &Credentials{Token: "example.com"}) {
+		t.Errorf("got credentials %#v from the helper", creds)
+	}
+	creds, err = helper.Credentials(context.Background(), "example.com", &Challenge{"basic", map[string]string{}})
+	if err != nil || creds != nil {
+		t.Errorf("got credentials %#v, %v from the helper, want none", creds, err)
+	}
+	helper = HelperCredentials{Command: []string{"false"}}
+	if _, err := helper.Credentials(context.Background(), "example.com", nil); err == nil {
+		t.Errorf("expected an error from a failing helper")
+	}
+}
+
+func TestDiscoverCredentials(t *testing.T) {
+	var auths []string
+	ts, d := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		auths = append(auths, auth)
+		switch auth {
+		case "Bearer token":
+			fmt.Fprint(w, testMeta)
+		case "Basic dXNlcjpwYXNz":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="https://auth.example.com"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.Header().Set("WWW-Authenticate", `Basic realm="discovery"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	defer ts.Close()
+	app := App{Name: "127.0.0.1", Labels: map[types.ACIdentifier]string{}}
+
+	// basic credentials are sent first, then a token for the bearer
+	// challenge
+	var challenges []*Challenge
+	d.Credentials = credentialsFunc(func(ctx context.Context, host string, ch *Challenge) (*Credentials, error) {
+		challenges = append(challenges, ch)
+		if ch != nil && ch.Scheme == "bearer" && ch.Params["realm"] == "https://auth.example.com" {
+			return &Credentials{Token: "token"}, nil
+		}
+		return &Credentials{User: "user", Password: "pass"}, nil
+	})
+	if _, _, err := d.DiscoverPublicKeys(context.Background(), app); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"Basic dXNlcjpwYXNz", "Bearer token"}
+	if !reflect.DeepEqual(auths, expected) {
+		t.Errorf("got authorizations %q, want %q", auths, expected)
+	}
+	if len(challenges) != 2 || challenges[0] != nil || challenges[1].Scheme != "bearer" {
+		t.Errorf("got challenges %v, want none then the bearer challenge", challenges)
+	}
+
+	// credentials are only sent once per challenge
+	auths = nil
+	d = &Discoverer{Client: d.Client, Port: d.Port, Credentials: StaticCredentials{"*": {User: "user", Password: "wrong"}}}
+	_, attempts, err := d.DiscoverPublicKeys(context.Background(), app)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if len(attempts) != 1 || attempts[0].Error.Error() != "expected a 200 OK got 401" {
+		t.Errorf("got attempts %v, want a 401", attempts)
+	}
+	if len(auths) != 1 {
+		t.Errorf("got authorizations %q, want only one", auths)
+	}
+}
+
+type credentialsFunc func(ctx context.Context, host string, ch *Challenge) (*Credentials, error)
+
+func (f credentialsFunc) Credentials(ctx context.Context, host string, ch *Challenge) (*Credentials, error) {
+	return f(ctx, host, ch)
+}
@@ -0,0 +1,427 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache stores the discovery meta tags fetched for each prefix.
+// Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns the entry stored for key, or nil if there is none.
+	Get(key string) (*CacheEntry, error)
+	// Put stores the entry for key, replacing the previous one.
+	Put(key string, entry *CacheEntry) error
+}
+
+// CacheEntry is the result of the discovery requests of a prefix.
+type CacheEntry struct {
+	// URL is the URL the meta tags were fetched from.
+	URL string `json:"url"`
+	// Meta are the discovery meta tags found.
+	Meta []CachedMeta `json:"meta"`
+	// ETag and LastModified are the validators of the response, used to
+	// revalidate the entry.
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	// Expires is the time until which the entry is fresh.
+	Expires time.Time `json:"expires"`
+	// NotFound is set if every discovery URL answered 404 Not Found.
+	NotFound bool `json:"notFound,omitempty"`
+}
+
+// CachedMeta is a discovery meta tag.
+type CachedMeta struct {
+	Name   string `json:"name"`
+	Prefix string `json:"prefix"`
+	URI    string `json:"uri"`
+}
+
+func newCacheEntry(urlStr string, meta []acMeta) *CacheEntry {
+	e := &CacheEntry{URL: urlStr}
+	for _, m := range meta {
+		e.Meta = append(e.Meta, CachedMeta{Name: m.name, Prefix: m.prefix, URI: m.uri})
+	}
+	return e
+}
+
+func (e *CacheEntry) acMeta() []acMeta {
+	var meta []acMeta
+	for _, m := range e.Meta {
+		meta = append(meta, acMeta{name: m.Name, prefix: m.Prefix, uri: m.URI})
+	}
+	return meta
+}
+
+// validators returns the headers making a request conditional on the entry
+// being modified.
+func (e *CacheEntry) validators() http.Header {
+	h := http.Header{}
+	if e.ETag != "" {
+		h.Set("If-None-Match", e.ETag)
+	}
+	if e.LastModified != "" {
+		h.Set("If-Modified-Since", e.LastModified)
+	}
+	return h
+}
+
+// update sets the validators and the expiration of the entry from a response.
+func (e *CacheEntry) update(h http.Header, now time.Time) (store bool) {
+	if etag := h.Get("ETag"); etag != "" {
+		e.ETag = etag
+	}
+	if lm := h.Get("Last-Modified"); lm != "" {
+		e.LastModified = lm
+	}
+	e.Expires, store = freshness(h, now)
+	return store
+}
+
+// freshness returns the time until which a response received at now is
+// fresh, according to its Cache-Control or Expires header, and whether it
+// may be stored. A response without explicit expiration is stored but must
+// be revalidated.
+func freshness(h http.Header, now time.Time) (expires time.Time, store bool) {
+	cc := make(map[string]string)
+	for _, d := range strings.Split(strings.Join(h["Cache-Control"], ","), ",") {
+		name, value := d, ""
+		if i := strings.Index(d, "="); i >= 0 {
+			name, value = d[:i], strings.Trim(strings.TrimSpace(d[i+1:]), `"`)
+		}
+		cc[strings.ToLower(strings.TrimSpace(name))] = value
+	}
+	if _, ok := cc["no-store"]; ok {
+		return now, false
+	}
+	if _, ok := cc["no-cache"]; ok {
+		return now, true
+	}
+	if v, ok := cc["max-age"]; ok {
+		maxAge, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return now, true
+		}
+		age, _ := strconv.ParseInt(h.Get("Age"), 10, 64)
+		return now.Add(time.Duration(maxAge-age) * time.Second), true
+	}
+	if v := h.Get("Expires"); v != "" {
+		exp, err := http.ParseTime(v)
+		if err != nil {
+			return now, true
+		}
+		// Expires is given by the clock of the server
+		if date, err := http.ParseTime(h.Get("Date")); err == nil {
+			return now.Add(exp.Sub(date)), true
+		}
+		return exp, true
+	}
+	return now, true
+}
+
+// negativeCacheTTL is how long the discovery URLs of a prefix answering 404
+// Not Found are remembered when the responses have no explicit expiration.
+const negativeCacheTTL = 5 * time.Minute
+
+// fetchMeta returns the URL and the discovery meta tags of the first of the
+// discovery URLs which succeeds, from the cache if possible. The URL is also
+// returned with the error of a document which cannot be parsed.
+func (d *Discoverer) fetchMeta(ctx context.Context, ids *identities, urls []*url.URL) (string, []acMeta, error) {
+	if d.Cache == nil {
+		urlStr, res, err := d.get(ctx, urls, nil)
+		if err != nil {
+			return "", nil, err
+		}
+		defer res.Body.Close()
+		meta, err := extractMeta(urlStr, res)
+		if err != nil {
+			return urlStr, nil, err
+		}
+		return urlStr, meta, nil
+	}
+
+	key, err := d.cacheKey(ctx, ids, urls)
+	if err != nil {
+		return "", nil, err
+	}
+	entry, err := d.Cache.Get(key)
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	if entry != nil && now.Before(entry.Expires) {
+		if entry.NotFound {
+			return "", nil, notFoundError(urls)
+		}
+		return entry.URL, entry.acMeta(), nil
+	}
+	if entry != nil && entry.NotFound {
+		entry = nil
+	}
+
+	urlStr, res, err := d.get(ctx, urls, entry)
+	if err != nil {
+		if entry != nil && d.unreachable(ctx, err) && now.Before(entry.Expires.Add(d.MaxStale)) {
+			return entry.URL, entry.acMeta(), nil
+		}
+		if h, ok := allNotFound(err, len(urls)); ok {
+			if perr := d.putNotFound(key, h, now); perr != nil {
+				return "", nil, perr
+			}
+		}
+		return "", nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNotModified {
+		meta, err := extractMeta(urlStr, res)
+		if err != nil {
+			return urlStr, nil, err
+		}
+		entry = newCacheEntry(urlStr, meta)
+	}
+	if !entry.update(res.Header, now) {
+		return entry.URL, entry.acMeta(), nil
+	}
+	if err := d.Cache.Put(key, entry); err != nil {
+		return "", nil, err
+	}
+	return entry.URL, entry.acMeta(), nil
+}
+
+// cacheKey returns the key of the entry of the discovery URLs: the URLs
+// and, if some of the requests are authenticated, the hash of the host
+// headers and of the credentials sent, so that the entries fetched with
+// different identities are not shared. The credentials are looked up once
+// per host through ids.
+func (d *Discoverer) cacheKey(ctx context.Context, ids *identities, urls []*url.URL) (string, error) {
+	var strs []string
+	h := sha256.New()
+	auth := false
+	for _, u := range urls {
+		strs = append(strs, u.String())
+		header := d.Headers[u.Host]
+		if len(header) != 0 {
+			auth = true
+			fmt.Fprintf(h, "%s\x00", u.Host)
+			if err := header.Write(h); err != nil {
+				return "", err
+			}
+		}
+		if d.Credentials == nil || u.Scheme != "https" || header.Get("Authorization") != "" {
+			continue
+		}
+		c, err := ids.credentials(ctx, d, u.Host)
+		if err != nil {
+			return "", err
+		}
+		if c != "" {
+			auth = true
+			fmt.Fprintf(h, "%s\x00%s\x00", u.Host, c)
+		}
+	}
+	key := strings.Join(strs, " ")
+	if auth {
+		key += fmt.Sprintf(" auth=%x", h.Sum(nil))
+	}
+	return key, nil
+}
+
+// identities memoizes the credentials of the hosts during a walk, so that
+// the credential provider, e.g. a helper command, is asked once per host
+// and walk rather than for every cache lookup.
+type identities struct {
+	mu    sync.Mutex
+	hosts map[string]string
+}
+
+// credentials returns the Authorization header value of the credentials of
+// host for a first request, empty if there are none.
+func (ids *identities) credentials(ctx context.Context, d *Discoverer, host string) (string, error) {
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+	if auth, ok := ids.hosts[host]; ok {
+		return auth, nil
+	}
+	c, err := d.Credentials.Credentials(ctx, host, nil)
+	if err != nil {
+		return "", err
+	}
+	var auth string
+	if c != nil {
+		auth = c.authorization(nil)
+	}
+	if ids.hosts == nil {
+		ids.hosts = make(map[string]string)
+	}
+	ids.hosts[host] = auth
+	return auth, nil
+}
+
+// allNotFound returns whether the error of the requests of n discovery URLs
+// is a 404 Not Found for each of them, and the headers of the last response.
+func allNotFound(err error, n int) (http.Header, bool) {
+	aerr, ok := err.(*attemptError)
+	if !ok || len(aerr.errs) != n {
+		return nil, false
+	}
+	var serr *statusError
+	for _, err := range aerr.errs {
+		if serr, ok = err.(*statusError); !ok || serr.code != http.StatusNotFound {
+			return nil, false
+		}
+	}
+	return serr.header, true
+}
+
+// putNotFound stores the negative entry of discovery URLs answering 404 Not
+// Found, with the headers of the last response.
+func (d *Discoverer) putNotFound(key string, h http.Header, now time.Time) error {
+	expires, store := freshness(h, now)
+	if !store {
+		return nil
+	}
+	if h.Get("Cache-Control") == "" && h.Get("Expires") == "" {
+		expires = now.Add(negativeCacheTTL)
+	}
+	return d.Cache.Put(key, &CacheEntry{NotFound: true, Expires: expires})
+}
+
+// notFoundError returns the error of discovery URLs all answering 404 Not
+// Found.
+func notFoundError(urls []*url.URL) error {
+	aerr := &attemptError{}
+	for _, u := range urls {
+		aerr.urls = append(aerr.urls, u.String())
+		aerr.errs = append(aerr.errs, &statusError{code: http.StatusNotFound})
+	}
+	return aerr
+}
+
+// unreachable returns whether the error of a discovery request allows to
+// use a stale entry: the server could not be reached or failed, and the
+// discovery was not canceled.
+func (d *Discoverer) unreachable(ctx context.Context, err error) bool {
+	if d.MaxStale <= 0 || ctx.Err() != nil {
+		return false
+	}
+	if aerr, ok := err.(*attemptError); ok {
+		err = aerr.last()
+	}
+	if serr, ok := err.(*statusError); ok {
+		return serr.code >= 500
+	}
+	return true
+}
+
+// MemoryCache is a Cache keeping the entries in memory.
+type MemoryCache struct {
+	mu      sync.RWMutex
+	entries map[string]CacheEntry
+}
+
+// NewMemoryCache returns an empty MemoryCache.
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{entries: make(map[string]CacheEntry)}
+}
+
+func (c *MemoryCache) Get(key string) (*CacheEntry, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	return &e, nil
+}
+
+func (c *MemoryCache) Put(key string, entry *CacheEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = *entry
+	return nil
+}
+
+// DiskCache is a Cache keeping each entry in a JSON file of a directory,
+// named after the hash of its key. Files are replaced atomically, so the
+// directory can be shared by several processes.
+type DiskCache struct {
+	dir string
+}
+
+// NewDiskCache returns the DiskCache in the given directory, creating it if
+// needed.
+func NewDiskCache(dir string) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DiskCache{dir: dir}, nil
+}
+
+func (c *DiskCache) path(key string) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%x.json", sha256.Sum256([]byte(key))))
+}
+
+// Get returns the entry stored for key. An unreadable entry is ignored.
+func (c *DiskCache) Get(key string) (*CacheEntry, error) {
+	b, err := ioutil.ReadFile(c.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var e CacheEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, nil
+	}
+	return &e, nil
+}
+
+func (c *DiskCache) Put(key string, entry *CacheEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(c.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.path(key))
+}
@@ -0,0 +1,322 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+)
+
+func TestFreshness(t *testing.T) {
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header  http.Header
+		expires time.Time
+		store   bool
+	}{
+		{
+			http.Header{},
+			now,
+			true,
+		},
+		{
+			http.Header{"Cache-Control": {"public, max-age=60"}},
+			now.Add(time.Minute),
+			true,
+		},
+		{
+			http.Header{"Cache-Control": {"max-age=60"}, "Age": {"20"}},
+			now.Add(40 * time.Second),
+			true,
+		},
+		{
+			http.Header{"Cache-Control": {"max-age=60", "no-cache"}},
+			now,
+			true,
+		},
+		{
+			http.Header{"Cache-Control": {"no-store"}},
+			now,
+			false,
+		},
+		// Expires is relative to the Date of the server
+		{
+			http.Header{
+				"Date":    {"Thu, 31 Dec 2015 00:00:00 GMT"},
+				"Expires": {"Thu, 31 Dec 2015 01:00:00 GMT"},
+			},
+			now.Add(time.Hour),
+			true,
+		},
+		{
+			http.Header{"Expires": {"Fri, 01 Jan 2016 00:10:00 GMT"}},
+			now.Add(10 * time.Minute),
+			true,
+		},
+		// max-age has precedence over Expires
+		{
+			http.Header{
+				"Cache-Control": {"max-age=10"},
+				"Expires":       {"Fri, 01 Jan 2016 00:10:00 GMT"},
+			},
+			now.Add(10 * time.Second),
+			true,
+		},
+		{
+			http.Header{"Expires": {"0"}},
+			now,
+			true,
+		},
+	}
+	for i, tt := range tests {
+		expires, store := freshness(tt.header, now)
+		if !expires.Equal(tt.expires) || store != tt.store {
+			t.Errorf("#%d: got %v, %t, want %v, %t", i, expires, store, tt.expires, tt.store)
+		}
+	}
+}
+
+func TestDiscoverCache(t *testing.T) {
+	var requests int
+	var cacheControl string
+	down := false
+	ts, d := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if down {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path != "/myapp" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", cacheControl)
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, testMeta)
+	})
+	defer ts.Close()
+	app := App{Name: "127.0.0.1/myapp", Labels: map[types.ACIdentifier]string{"version": "1.0.0"}}
+	expected := "https://storage.example.com/127.0.0.1/myapp-1.0.0.aci"
+
+	dir, err := ioutil.TempDir("", "discovery-cache")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	diskCache, err := NewDiskCache(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, cache := range []Cache{NewMemoryCache(), diskCache} {
+		requests = 0
+		down = false
+		cacheControl = "max-age=3600"
+		d := &Discoverer{Client: d.Client, Port: d.Port, Cache: cache}
+		discover := func(what string, wantRequests int, wantErr bool) {
+			eps, _, err := d.DiscoverACIEndpoints(context.Background(), app)
+			if err != nil && !wantErr {
+				t.Fatalf("%T: %s: unexpected error: %v", cache, what, err)
+			}
+			if err == nil && wantErr {
+				t.Errorf("%T: %s: expected an error", cache, what)
+			}
+			if err == nil && (len(eps) != 1 || eps[0].ACI != expected) {
+				t.Errorf("%T: %s: got endpoints %v, want %s", cache, what, eps, expected)
+			}
+			if requests != wantRequests {
+				t.Errorf("%T: %s: got %d requests, want %d", cache, what, requests, wantRequests)
+			}
+			requests = 0
+		}
+
+		discover("first discovery", 1, false)
+		discover("fresh entry", 0, false)
+
+		// an expired entry is revalidated, the server answering 304
+		urls, err := d.discoveryURLs("127.0.0.1/myapp", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		key, err := d.cacheKey(context.Background(), &identities{}, urls)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		entry, err := cache.Get(key)
+		if err != nil || entry == nil {
+			t.Fatalf("%T: got entry %v, %v", cache, entry, err)
+		}
+		entry.Expires = time.Now().Add(-time.Minute)
+		if err := cache.Put(key, entry); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		cacheControl = "no-cache"
+		discover("revalidation", 1, false)
+		discover("revalidation without max-age", 1, false)
+
+		// stale entries are only served when allowed
+		down = true
+		discover("server down", 2, true)
+		d = &Discoverer{Client: d.Client, Port: d.Port, Cache: cache, MaxStale: time.Hour}
+		discover("server down with MaxStale", 1, false)
+	}
+}
+
+func TestDiscoverCacheNotFound(t *testing.T) {
+	var requests int
+	ts, d := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.NotFound(w, r)
+	})
+	defer ts.Close()
+	d.Cache = NewMemoryCache()
+	app := App{Name: "127.0.0.1/myapp", Labels: map[types.ACIdentifier]string{"version": "1.0.0"}}
+
+	for i, want := range []int{2, 0} {
+		requests = 0
+		_, attempts, err := d.DiscoverACIEndpoints(context.Background(), app)
+		if err == nil {
+			t.Fatalf("#%d: expected an error", i)
+		}
+		if requests != want {
+			t.Errorf("#%d: got %d requests, want %d", i, requests, want)
+		}
+		if len(attempts) != 2 || attempts[0].Reason != FailureHTTPStatus || attempts[0].Failures[0].StatusCode != http.StatusNotFound {
+			t.Errorf("#%d: got attempts %v, want two 404 attempts", i, attempts)
+		}
+	}
+}
+
+func TestDiscoverCacheIdentity(t *testing.T) {
+	var requests int
+	ts, d := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", "max-age=3600")
+		fmt.Fprint(w, testMeta)
+	})
+	defer ts.Close()
+	host := "127.0.0.1:" + strconv.FormatUint(uint64(d.Port), 10)
+	cache := NewMemoryCache()
+	app := App{Name: "127.0.0.1/myapp", Labels: map[types.ACIdentifier]string{"version": "1.0.0"}}
+
+	tests := []struct {
+		headers  map[string]http.Header
+		creds    CredentialProvider
+		requests int
+	}{
+		{nil, nil, 1},
+		{nil, nil, 0},
+		{nil, StaticCredentials{host: {Token: "alice"}}, 1},
+		{nil, StaticCredentials{host: {Token: "alice"}}, 0},
+		{nil, StaticCredentials{host: {Token: "bob"}}, 1},
+		{map[string]http.Header{host: {"Authorization": {"Bearer carol"}}}, nil, 1},
+		{map[string]http.Header{host: {"Authorization": {"Bearer carol"}}}, nil, 0},
+	}
+	for i, tt := range tests {
+		requests = 0
+		d := &Discoverer{Client: d.Client, Port: d.Port, Cache: cache, Headers: tt.headers, Credentials: tt.creds}
+		if _, _, err := d.DiscoverACIEndpoints(context.Background(), app); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if requests != tt.requests {
+			t.Errorf("#%d: got %d requests, want %d", i, requests, tt.requests)
+		}
+	}
+}
+
+// countingCredentials counts the lookups of its credentials.
+type countingCredentials struct {
+	calls int
+}
+
+func (c *countingCredentials) Credentials(ctx context.Context, host string, ch *Challenge) (*Credentials, error) {
+	c.calls++
+	return &Credentials{Token: "alice"}, nil
+}
+
+func TestDiscoverCacheCredentialLookups(t *testing.T) {
+	ts, d := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, testMeta)
+	})
+	defer ts.Close()
+	creds := &countingCredentials{}
+	d.Cache = NewMemoryCache()
+	d.Credentials = creds
+	app := App{Name: "127.0.0.1/myapp/sub", Labels: map[types.ACIdentifier]string{"version": "1.0.0"}}
+
+	if _, _, err := d.DiscoverACIEndpoints(context.Background(), app); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the three prefixes are cached, the credentials are only looked up
+	// once for their keys
+	creds.calls = 0
+	if _, _, err := d.DiscoverACIEndpoints(context.Background(), app); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if creds.calls != 1 {
+		t.Errorf("got %d credential lookups, want 1", creds.calls)
+	}
+}
+
+func TestGetRevalidatesEntryURL(t *testing.T) {
+	ts, d := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/a" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("If-None-Match") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		http.NotFound(w, r)
+	})
+	defer ts.Close()
+	a, _ := url.Parse(ts.URL + "/a")
+	b, _ := url.Parse(ts.URL + "/b")
+
+	// b is not the URL of the entry, its request is not conditional
+	entry := &CacheEntry{URL: a.String(), ETag: `"v1"`}
+	if _, res, err := d.get(context.Background(), []*url.URL{a, b}, entry); err == nil {
+		res.Body.Close()
+		t.Errorf("expected an error")
+	}
+	entry.URL = b.String()
+	_, res, err := d.get(context.Background(), []*url.URL{a, b}, entry)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("got status %d, want 304", res.StatusCode)
+	}
+}
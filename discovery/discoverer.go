@@ -0,0 +1,162 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Discoverer performs discovery with its own HTTP configuration. The zero
+// value is usable and behaves like the package level functions, using Client
+// and ClientInsecureTLS.
+//
+// A Discoverer can be used concurrently but must not be modified or copied
+// after its first use.
+type Discoverer struct {
+	// Client is the client used for the requests. If nil, a client is
+	// created from TLSConfig and DialTimeout. With InsecureTLS, the
+	// requests use a copy of Client whose transport, if it is an
+	// http.Transport, skips the verification of the server certificates.
+	Client *http.Client
+	// TLSConfig is the TLS configuration of the created client.
+	TLSConfig *tls.Config
+	// HostTLS are the TLS configurations of some hosts, looked up with the
+	// port of the host, then without; the "*" key matches every host.
+	HostTLS map[string]*HostTLSConfig
+	// DialTimeout is the dial timeout of the created client, 20 seconds if
+	// zero.
+	DialTimeout time.Duration
+	// Timeout limits the time of each request, reading the response
+	// included. Zero means no limit.
+	Timeout time.Duration
+	// Headers are the headers to apply depending on the host (e.g.
+	// authentication).
+	Headers map[string]http.Header
+	// Credentials, if set, provides the credentials of the hosts, sent over
+	// HTTPS.
+	Credentials CredentialProvider
+	// Insecure allows, if set, to skip the TLS verification or to fall back
+	// to HTTP.
+	Insecure InsecureOption
+	// Port is the port of the requests, the default port of the scheme if
+	// zero.
+	Port uint
+	// BaseURL, if set, is the URL of a mirror of the discovery sites, the
+	// discovery document of a prefix being fetched from BaseURL/prefix
+	// instead of https://prefix. A path without scheme is a local
+	// directory.
+	BaseURL string
+	// WellKnown, if set, first tries the JSON discovery document at the
+	// well-known path of the host, /.well-known/ac-discovery.json, fetched
+	// once per walk. The discovery URLs of a prefix are only requested if
+	// it cannot be fetched or parsed, or has no meta tags for the name. It
+	// is not used with BaseURL or a mirror rule.
+	WellKnown bool
+	// Mirrors are the rules redirecting the discovery of some images to
+	// mirrors, the rule with the longest matching prefix being applied.
+	Mirrors []MirrorRule
+	// Fetchers are the fetchers to use for the given URL schemes, instead
+	// of the default ones.
+	Fetchers map[string]Fetcher
+	// Parallel, if set, discovers all the prefixes of a name concurrently
+	// instead of one after the other.
+	Parallel bool
+	// Cache, if set, stores the meta tags fetched for each prefix, and the
+	// prefixes not found. They are reused while fresh and revalidated once
+	// expired. The entries are keyed by the discovery URLs and by the
+	// identity the requests are authenticated with.
+	Cache Cache
+	// MaxStale is how long after their expiration the cached meta tags are
+	// still used when the discovery URL cannot be reached. Zero disables
+	// stale results.
+	MaxStale time.Duration
+
+	once          sync.Once
+	do            httpDoer
+	doInsecureTLS httpDoer
+
+	mu        sync.Mutex
+	hostDoers map[hostDoerKey]httpDoer
+}
+
+type hostDoerKey struct {
+	host        string
+	config      *HostTLSConfig
+	insecureTLS bool
+}
+
+func newDiscoverer(hostHeaders map[string]http.Header, insecure InsecureOption, port uint) *Discoverer {
+	return &Discoverer{Headers: hostHeaders, Insecure: insecure, Port: port}
+}
+
+// doer returns the httpDoer to use for the requests to the host.
+func (d *Discoverer) doer(host string, insecureTLS bool) (httpDoer, error) {
+	if hc := d.hostTLS(host); hc != nil {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		key := hostDoerKey{host, hc, insecureTLS}
+		if do, ok := d.hostDoers[key]; ok {
+			return do, nil
+		}
+		do, err := d.newHostDoer(host, hc, insecureTLS)
+		if err != nil {
+			return nil, err
+		}
+		if d.hostDoers == nil {
+			d.hostDoers = make(map[hostDoerKey]httpDoer)
+		}
+		d.hostDoers[key] = do
+		return do, nil
+	}
+	d.once.Do(d.initClients)
+	if insecureTLS {
+		return d.doInsecureTLS, nil
+	}
+	return d.do, nil
+}
+
+func (d *Discoverer) initClients() {
+	switch {
+	case d.Client != nil:
+		d.do = d.Client
+		c := *d.Client
+		t := c.Transport
+		if t == nil {
+			t = http.DefaultTransport
+		}
+		if t, ok := t.(*http.Transport); ok {
+			t = t.Clone()
+			if t.TLSClientConfig == nil {
+				t.TLSClientConfig = &tls.Config{}
+			}
+			t.TLSClientConfig.InsecureSkipVerify = true
+			c.Transport = t
+		}
+		d.doInsecureTLS = &c
+	case d.TLSConfig != nil || d.DialTimeout != 0:
+		dialTimeout := d.DialTimeout
+		if dialTimeout == 0 {
+			dialTimeout = defaultDialTimeout
+		}
+		d.do = &http.Client{Transport: newTransport(d.TLSConfig, dialTimeout, false)}
+		d.doInsecureTLS = &http.Client{Transport: newTransport(d.TLSConfig, dialTimeout, true)}
+	default:
+		d.do = httpDo
+		d.doInsecureTLS = httpDoInsecureTLS
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+)
+
+const testMeta = `<html><head>
+<meta name="ac-discovery" content="127.0.0.1 https://storage.example.com/{name}-{version}.{ext}">
+<meta name="ac-discovery-pubkeys" content="127.0.0.1 https://example.com/pubkeys.gpg">
+</head></html>`
+
+// newTestServer starts a TLS server serving the discovery meta tags for
+// 127.0.0.1/myapp and returns a Discoverer using it.
+func newTestServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *Discoverer) {
+	ts := httptest.NewTLSServer(handler)
+	return ts, &Discoverer{Client: ts.Client(), Port: serverPort(t, ts)}
+}
+
+func serverPort(t *testing.T, ts *httptest.Server) uint {
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	port, err := strconv.ParseUint(u.Port(), 10, 16)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return uint(port)
+}
+
+func TestDiscoverer(t *testing.T) {
+	var auth string
+	ts, d := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		if r.URL.Path != "/myapp" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, testMeta)
+	})
+	defer ts.Close()
+	host := "127.0.0.1:" + strconv.FormatUint(uint64(d.Port), 10)
+	d.Headers = map[string]http.Header{host: {"Authorization": {"Basic Zm9vOmJhcg=="}}}
+
+	app := App{Name: "127.0.0.1/myapp/sub", Labels: map[types.ACIdentifier]string{"version": "1.0.0"}}
+	eps, attempts, err := d.DiscoverACIEndpoints(context.Background(), app)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "https://storage.example.com/127.0.0.1/myapp/sub-1.0.0.aci"
+	if len(eps) != 1 || eps[0].ACI != expected {
+		t.Errorf("got endpoints %v, want %s", eps, expected)
+	}
+	if len(attempts) != 1 || attempts[0].Prefix != "127.0.0.1/myapp/sub" {
+		t.Errorf("got attempts %v, want a failure for 127.0.0.1/myapp/sub", attempts)
+	}
+	if auth != "Basic Zm9vOmJhcg==" {
+		t.Errorf("got authorization %q, want the host header", auth)
+	}
+
+	keys, _, err := d.DiscoverPublicKeys(context.Background(), app)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 1 || keys[0] != "https://example.com/pubkeys.gpg" {
+		t.Errorf("got public keys %v", keys)
+	}
+
+	// the server certificate is not trusted without the test client. A TLS
+	// configuration avoids the package clients, replaced by other tests.
+	d = &Discoverer{Port: d.Port, TLSConfig: &tls.Config{}}
+	if _, _, err := d.DiscoverACIEndpoints(context.Background(), app); err == nil {
+		t.Errorf("expected an error with an untrusted certificate")
+	}
+	d = &Discoverer{Port: d.Port, TLSConfig: &tls.Config{}, Insecure: InsecureTLS}
+	if _, _, err := d.DiscoverACIEndpoints(context.Background(), app); err != nil {
+		t.Errorf("unexpected error with InsecureTLS: %v", err)
+	}
+}
+
+func TestDiscovererContext(t *testing.T) {
+	block := make(chan struct{})
+	ts, d := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	})
+	defer ts.Close()
+	defer close(block)
+	app := App{Name: "127.0.0.1/myapp", Labels: map[types.ACIdentifier]string{}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, attempts, err := d.DiscoverACIEndpoints(ctx, app)
+	if err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if len(attempts) != 0 {
+		t.Errorf("got attempts %v, want none", attempts)
+	}
+
+	d.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	_, attempts, err = d.DiscoverACIEndpoints(context.Background(), app)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if len(attempts) != 2 {
+		t.Errorf("got %d attempts, want 2", len(attempts))
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("discovery took %v despite the timeout", elapsed)
+	}
+}
+
+func TestDiscoverParallel(t *testing.T) {
+	var mu sync.Mutex
+	canceled := make(map[string]bool)
+	ts, d := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a/b/c":
+			http.NotFound(w, r)
+		case "/a/b":
+			// answers after the shorter prefixes
+			time.Sleep(100 * time.Millisecond)
+			fmt.Fprint(w, testMeta)
+		case "/a":
+			fmt.Fprint(w, testMeta)
+		default:
+			select {
+			case <-r.Context().Done():
+				mu.Lock()
+				canceled[r.URL.Path] = true
+				mu.Unlock()
+			case <-time.After(10 * time.Second):
+			}
+		}
+	})
+	defer ts.Close()
+	d.Parallel = true
+	app := App{Name: "127.0.0.1/a/b/c", Labels: map[types.ACIdentifier]string{}}
+
+	var prefixes []string
+	dd, err := d.DiscoverWalk(context.Background(), app, func(pre string, dd *Result, err error) error {
+		prefixes = append(prefixes, pre)
+		if err == nil {
+			return errEnough
+		}
+		return nil
+	})
+	if err != errEnough {
+		t.Fatalf("got error %v, want %v", err, errEnough)
+	}
+	expected := []string{"127.0.0.1/a/b/c", "127.0.0.1/a/b"}
+	if !reflect.DeepEqual(prefixes, expected) {
+		t.Errorf("got prefixes %v, want the longest successful one %v", prefixes, expected)
+	}
+	if len(dd.PublicKeys) != 1 {
+		t.Errorf("got public keys %v, want one", dd.PublicKeys)
+	}
+
+	// the request of the shortest prefix is canceled
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		done := canceled["/"] || canceled[""]
+		mu.Unlock()
+		if done {
+			return
+		}
+	}
+	t.Errorf("the request of 127.0.0.1 was not canceled")
+}
@@ -15,11 +15,13 @@
 package discovery
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"regexp"
+	"sort"
 	"strings"
 
 	"golang.org/x/net/html"
@@ -37,12 +39,16 @@ type ACIEndpoint struct {
 	ASC string
 }
 
-// A struct containing both discovered endpoints and keys. Used to avoid
-// function duplication (one for endpoints and one for keys, so to avoid two
-// doDiscover, two DiscoverWalkFunc)
-type discoveryData struct {
+// Result contains both the endpoints and the keys discovered for a prefix.
+// Used to avoid function duplication (one for endpoints and one for keys, so
+// to avoid two doDiscover, two DiscoverWalkFunc)
+type Result struct {
+	// URL is the URL of the discovery document.
+	URL          string
 	ACIEndpoints []ACIEndpoint
 	PublicKeys   []string
+	// Warnings are the warnings about the ac-discovery meta tags.
+	Warnings []TemplateWarning
 }
 
 type ACIEndpoints []ACIEndpoint
@@ -54,7 +60,7 @@ const (
 )
 
 var (
-	templateExpression = regexp.MustCompile(`{.*?}`)
+	templateExpression = regexp.MustCompile(`{[^{}]*}`)
 	errEnough          = errors.New("enough discovery information found")
 )
 
@@ -107,42 +113,93 @@ func extractACMeta(r io.Reader) []acMeta {
 	}
 }
 
-func renderTemplate(tpl string, kvs ...string) (string, bool) {
-	for i := 0; i < len(kvs); i += 2 {
-		k := kvs[i]
-		v := kvs[i+1]
-		tpl = strings.Replace(tpl, k, v, -1)
-	}
-	return tpl, !templateExpression.MatchString(tpl)
+// renderTemplate replaces the {variables} of the template by their value,
+// leaving the variables without value in place. It returns the rendered
+// template with the sorted names of the variables used and missing.
+func renderTemplate(tpl string, vars map[string]string) (rendered string, used []string, missing []string) {
+	seen := make(map[string]bool)
+	rendered = templateExpression.ReplaceAllStringFunc(tpl, func(v string) string {
+		name := v[1 : len(v)-1]
+		value, ok := vars[name]
+		if !seen[name] {
+			seen[name] = true
+			if ok {
+				used = append(used, name)
+			} else {
+				missing = append(missing, name)
+			}
+		}
+		if !ok {
+			return v
+		}
+		return value
+	})
+	sort.Strings(used)
+	sort.Strings(missing)
+	return rendered, used, missing
 }
 
-func createTemplateVars(app App) []string {
-	tplVars := []string{"{name}", app.Name.String()}
-	// If a label is called "name", it will be ignored as it appears after
-	// in the slice
+// templateVars returns the values of the template variables of the app: its
+// labels and its name, which has precedence over a label called name.
+func templateVars(app App) map[string]string {
+	vars := make(map[string]string)
 	for n, v := range app.Labels {
-		tplVars = append(tplVars, fmt.Sprintf("{%s}", n), v)
+		vars[n.String()] = v
 	}
-	return tplVars
+	vars["name"] = app.Name.String()
+	return vars
+}
+
+// TemplateWarning reports the problems of the template of an ac-discovery
+// meta tag.
+type TemplateWarning struct {
+	// Prefix is the prefix whose discovery document has the meta tag.
+	Prefix string
+	// Template is the template of the meta tag.
+	Template string
+	// Missing are the variables of the template without value. The meta
+	// tag is ignored if there are some.
+	Missing []string
+	// Unused are the labels of the app not used by the template, other
+	// than os and arch.
+	Unused []string
 }
 
-func doDiscover(pre string, hostHeaders map[string]http.Header, app App, insecure InsecureOption, port uint) (*discoveryData, error) {
+// walk is the state shared by the discovery of the prefixes of a name.
+type walk struct {
+	// doc is the well-known document of the host.
+	doc wellKnownDocument
+	// ids are the credentials of the hosts requested.
+	ids identities
+}
+
+func (d *Discoverer) doDiscover(ctx context.Context, pre string, app App, w *walk) (*Result, error) {
 	app = *app.Copy()
+	var labels []string
+	for n := range app.Labels {
+		// os and arch are set by default by most clients, so templates
+		// not using them are not reported
+		if n != "os" && n != "arch" {
+			labels = append(labels, n.String())
+		}
+	}
+	sort.Strings(labels)
 	if app.Labels["version"] == "" {
 		app.Labels["version"] = defaultVersion
 	}
 
-	_, body, err := httpsOrHTTP(pre, hostHeaders, insecure, port)
+	rule := d.mirrorRule(app.Name)
+	urlStr, meta, err := d.fetchDocument(ctx, pre, app.Name, rule, w)
+	if aerr, ok := err.(*attemptError); ok && rule != nil {
+		aerr.mirror = rule.Prefix
+	}
 	if err != nil {
 		return nil, err
 	}
-	defer body.Close()
-
-	meta := extractACMeta(body)
 
-	tplVars := createTemplateVars(app)
+	vars := templateVars(app)
 
-	dd := &discoveryData{}
+	dd := &Result{URL: urlStr}
 
 	for _, m := range meta {
 		if !strings.HasPrefix(app.Name.String(), m.prefix) {
@@ -151,14 +208,26 @@ func doDiscover(pre string, hostHeaders map[string]http.Header, app App, insecur
 
 		switch m.name {
 		case "ac-discovery":
-			// Ignore not handled variables as {ext} isn't already rendered.
-			uri, _ := renderTemplate(m.uri, tplVars...)
-			asc, ok := renderTemplate(uri, "{ext}", "aci.asc")
-			if !ok {
-				continue
+			// {ext} is the extension of the endpoint
+			vars["ext"] = "aci"
+			aci, used, missing := renderTemplate(m.uri, vars)
+			vars["ext"] = "aci.asc"
+			asc, _, _ := renderTemplate(m.uri, vars)
+			var unused []string
+			for _, l := range labels {
+				if i := sort.SearchStrings(used, l); i == len(used) || used[i] != l {
+					unused = append(unused, l)
+				}
+			}
+			if len(missing) != 0 || len(unused) != 0 {
+				dd.Warnings = append(dd.Warnings, TemplateWarning{
+					Prefix:   pre,
+					Template: m.uri,
+					Missing:  missing,
+					Unused:   unused,
+				})
 			}
-			aci, ok := renderTemplate(uri, "{ext}", "aci")
-			if !ok {
+			if len(missing) != 0 {
 				continue
 			}
 			dd.ACIEndpoints = append(dd.ACIEndpoints, ACIEndpoint{ACI: aci, ASC: asc})
@@ -168,6 +237,15 @@ func doDiscover(pre string, hostHeaders map[string]http.Header, app App, insecur
 		}
 	}
 
+	if rule != nil {
+		for i, ep := range dd.ACIEndpoints {
+			dd.ACIEndpoints[i] = ACIEndpoint{ACI: rule.rewrite(ep.ACI), ASC: rule.rewrite(ep.ASC)}
+		}
+		for i, k := range dd.PublicKeys {
+			dd.PublicKeys[i] = rule.rewrite(k)
+		}
+	}
+
 	return dd, nil
 }
 
@@ -176,13 +254,45 @@ func doDiscover(pre string, hostHeaders map[string]http.Header, app App, insecur
 // header to apply depending on the host (e.g. authentication). Based on the
 // response of the discoverFn it will continue to recurse up the tree. If port
 // is 0, the default port will be used.
-func DiscoverWalk(app App, hostHeaders map[string]http.Header, insecure InsecureOption, port uint, discoverFn DiscoverWalkFunc) (dd *discoveryData, err error) {
+func DiscoverWalk(app App, hostHeaders map[string]http.Header, insecure InsecureOption, port uint, discoverFn DiscoverWalkFunc) (dd *Result, err error) {
+	return newDiscoverer(hostHeaders, insecure, port).DiscoverWalk(context.Background(), app, discoverFn)
+}
+
+// DiscoverWalk is like the DiscoverWalk function, using the configuration of
+// the Discoverer. It stops with the error of the context when it is done.
+//
+// If Parallel is set, all the prefixes are discovered concurrently, but
+// discoverFn is still called for each prefix in order, longest first. The
+// requests still outstanding are canceled once discoverFn stops the walk.
+func (d *Discoverer) DiscoverWalk(ctx context.Context, app App, discoverFn DiscoverWalkFunc) (dd *Result, err error) {
 	parts := strings.Split(string(app.Name), "/")
+	prefixes := make([]string, len(parts))
 	for i := range parts {
 		end := len(parts) - i
-		pre := strings.Join(parts[:end], "/")
+		prefixes[i] = strings.Join(parts[:end], "/")
+	}
+
+	// the well-known document and the credentials of the host are shared
+	// by all the prefixes
+	w := &walk{}
+	discover := func(i int) (*Result, error) {
+		return d.doDiscover(ctx, prefixes[i], app, w)
+	}
+	if d.Parallel {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		discover = d.discoverAll(ctx, prefixes, app, w)
+	}
 
-		dd, err = doDiscover(pre, hostHeaders, app, insecure, port)
+	for i, pre := range prefixes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		dd, err = discover(i)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		if derr := discoverFn(pre, dd, err); derr != nil {
 			return dd, derr
 		}
@@ -191,25 +301,60 @@ func DiscoverWalk(app App, hostHeaders map[string]http.Header, insecure Insecure
 	return nil, fmt.Errorf("discovery failed")
 }
 
+type discoverResult struct {
+	dd  *Result
+	err error
+}
+
+// discoverAll starts the discovery of all the prefixes and returns the
+// function waiting for the result of a prefix.
+func (d *Discoverer) discoverAll(ctx context.Context, prefixes []string, app App, w *walk) func(i int) (*Result, error) {
+	results := make([]chan discoverResult, len(prefixes))
+	for i, pre := range prefixes {
+		results[i] = make(chan discoverResult, 1)
+		go func(pre string, res chan<- discoverResult) {
+			dd, err := d.doDiscover(ctx, pre, app, w)
+			res <- discoverResult{dd, err}
+		}(pre, results[i])
+	}
+	return func(i int) (*Result, error) {
+		select {
+		case r := <-results[i]:
+			return r.dd, r.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
 // DiscoverWalkFunc can stop a DiscoverWalk by returning non-nil error.
-type DiscoverWalkFunc func(prefix string, dd *discoveryData, err error) error
+type DiscoverWalkFunc func(prefix string, dd *Result, err error) error
 
 // FailedAttempt represents a failed discovery attempt. This is for debugging
 // and user feedback.
 type FailedAttempt struct {
 	Prefix string
 	Error  error
+	// URLs are the URLs tried for the prefix, in order.
+	URLs []string
+	// Mirror is the prefix of the mirror rule applied, if any.
+	Mirror string
+	// Reason is the reason of the last failure.
+	Reason FailureReason
+	// Failures are the failures of the URLs tried, in order.
+	Failures []Failure
 }
 
-func walker(attempts *[]FailedAttempt, testFn DiscoverWalkFunc) DiscoverWalkFunc {
-	return func(pre string, dd *discoveryData, err error) error {
-		if err != nil {
-			*attempts = append(*attempts, FailedAttempt{pre, err})
-			return nil
-		}
-		if err := testFn(pre, dd, err); err != nil {
-			return err
+// walker returns the DiscoverWalkFunc recording the failed attempts, and
+// stopping the walk once found returns nil for the result of a prefix.
+func walker(attempts *[]FailedAttempt, found func(dd *Result) error) DiscoverWalkFunc {
+	return func(pre string, dd *Result, err error) error {
+		if err == nil {
+			if err = found(dd); err == nil {
+				return errEnough
+			}
 		}
+		*attempts = append(*attempts, newFailedAttempt(pre, dd, err))
 		return nil
 	}
 }
@@ -220,20 +365,41 @@ func walker(attempts *[]FailedAttempt, testFn DiscoverWalkFunc) DiscoverWalkFunc
 // It will not give up until it has exhausted the path or found an image
 // discovery. If port is 0, the default port will be used.
 func DiscoverACIEndpoints(app App, hostHeaders map[string]http.Header, insecure InsecureOption, port uint) (ACIEndpoints, []FailedAttempt, error) {
-	testFn := func(pre string, dd *discoveryData, err error) error {
+	return newDiscoverer(hostHeaders, insecure, port).DiscoverACIEndpoints(context.Background(), app)
+}
+
+// DiscoverACIEndpoints is like the DiscoverACIEndpoints function, using the
+// configuration of the Discoverer.
+func (d *Discoverer) DiscoverACIEndpoints(ctx context.Context, app App) (ACIEndpoints, []FailedAttempt, error) {
+	eps, _, attempts, err := d.DiscoverACIEndpointsWithWarnings(ctx, app)
+	return eps, attempts, err
+}
+
+// DiscoverACIEndpointsWithWarnings is like DiscoverACIEndpoints, also
+// returning the warnings about the ac-discovery meta tags of the prefixes
+// walked.
+func (d *Discoverer) DiscoverACIEndpointsWithWarnings(ctx context.Context, app App) (ACIEndpoints, []TemplateWarning, []FailedAttempt, error) {
+	var warnings []TemplateWarning
+	found := func(dd *Result) error {
+		warnings = append(warnings, dd.Warnings...)
 		if len(dd.ACIEndpoints) != 0 {
-			return errEnough
+			return nil
 		}
-		return nil
+		for _, w := range dd.Warnings {
+			if len(w.Missing) != 0 {
+				return &metaError{FailureTemplate, fmt.Sprintf("no ac-discovery meta tag rendered: missing %s", strings.Join(w.Missing, ", "))}
+			}
+		}
+		return &metaError{FailureNoMetaTag, "no ac-discovery meta tag"}
 	}
 
 	attempts := []FailedAttempt{}
-	dd, err := DiscoverWalk(app, hostHeaders, insecure, port, walker(&attempts, testFn))
+	dd, err := d.DiscoverWalk(ctx, app, walker(&attempts, found))
 	if err != nil && err != errEnough {
-		return nil, attempts, err
+		return nil, warnings, attempts, err
 	}
 
-	return dd.ACIEndpoints, attempts, nil
+	return dd.ACIEndpoints, warnings, attempts, nil
 }
 
 // DiscoverPublicKey will make HTTPS requests to find the ac-public-keys meta
@@ -242,15 +408,21 @@ func DiscoverACIEndpoints(app App, hostHeaders map[string]http.Header, insecure
 // It will not give up until it has exhausted the path or found an public key.
 // If port is 0, the default port will be used.
 func DiscoverPublicKeys(app App, hostHeaders map[string]http.Header, insecure InsecureOption, port uint) (PublicKeys, []FailedAttempt, error) {
-	testFn := func(pre string, dd *discoveryData, err error) error {
+	return newDiscoverer(hostHeaders, insecure, port).DiscoverPublicKeys(context.Background(), app)
+}
+
+// DiscoverPublicKeys is like the DiscoverPublicKeys function, using the
+// configuration of the Discoverer.
+func (d *Discoverer) DiscoverPublicKeys(ctx context.Context, app App) (PublicKeys, []FailedAttempt, error) {
+	found := func(dd *Result) error {
 		if len(dd.PublicKeys) != 0 {
-			return errEnough
+			return nil
 		}
-		return nil
+		return &metaError{FailureNoMetaTag, "no ac-discovery-pubkeys meta tag"}
 	}
 
 	attempts := []FailedAttempt{}
-	dd, err := DiscoverWalk(app, hostHeaders, insecure, port, walker(&attempts, testFn))
+	dd, err := d.DiscoverWalk(ctx, app, walker(&attempts, found))
 	if err != nil && err != errEnough {
 		return nil, attempts, err
 	}
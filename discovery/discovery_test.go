@@ -16,6 +16,7 @@ package discovery
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -592,3 +593,92 @@ func TestDiscoverEndpoints(t *testing.T) {
 		}
 	}
 }
+
+func TestRenderTemplate(t *testing.T) {
+	vars := map[string]string{"name": "example.com/myapp", "version": "{os}", "os": "linux"}
+	tests := []struct {
+		tpl      string
+		rendered string
+		used     []string
+		missing  []string
+	}{
+		{
+			"https://example.com/{name}-{os}.aci",
+			"https://example.com/example.com/myapp-linux.aci",
+			[]string{"name", "os"},
+			nil,
+		},
+		// values are not rendered again
+		{
+			"https://example.com/{name}-{version}.aci",
+			"https://example.com/example.com/myapp-{os}.aci",
+			[]string{"name", "version"},
+			nil,
+		},
+		{
+			"https://example.com/{name}-{arch}-{channel}-{arch}.aci",
+			"https://example.com/example.com/myapp-{arch}-{channel}-{arch}.aci",
+			[]string{"name"},
+			[]string{"arch", "channel"},
+		},
+		{"https://example.com/myapp.aci", "https://example.com/myapp.aci", nil, nil},
+	}
+	for i, tt := range tests {
+		rendered, used, missing := renderTemplate(tt.tpl, vars)
+		if rendered != tt.rendered {
+			t.Errorf("#%d: got %q, want %q", i, rendered, tt.rendered)
+		}
+		if !reflect.DeepEqual(used, tt.used) || !reflect.DeepEqual(missing, tt.missing) {
+			t.Errorf("#%d: got used %v and missing %v, want %v and %v", i, used, missing, tt.used, tt.missing)
+		}
+	}
+}
+
+func TestTemplateWarnings(t *testing.T) {
+	ts, d := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/myapp":
+			fmt.Fprint(w, `<meta name="ac-discovery" content="127.0.0.1/myapp https://storage.example.com/{name}-{version}-{channel}.{ext}">`)
+		case "/":
+			fmt.Fprint(w, testMeta)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer ts.Close()
+
+	app := App{
+		Name: "127.0.0.1/myapp",
+		Labels: map[types.ACIdentifier]string{
+			"version": "1.0.0",
+			"os":      "linux",
+			"arch":    "amd64",
+			"flavor":  "minimal",
+		},
+	}
+	eps, warnings, _, err := d.DiscoverACIEndpointsWithWarnings(context.Background(), app)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(eps) != 1 || eps[0].ACI != "https://storage.example.com/127.0.0.1/myapp-1.0.0.aci" {
+		t.Errorf("got endpoints %v, want the endpoint of 127.0.0.1", eps)
+	}
+	// the meta tag of 127.0.0.1/myapp is ignored and reported, os and
+	// arch are never reported as unused
+	expected := []TemplateWarning{
+		{
+			Prefix:   "127.0.0.1/myapp",
+			Template: "https://storage.example.com/{name}-{version}-{channel}.{ext}",
+			Missing:  []string{"channel"},
+			Unused:   []string{"flavor"},
+		},
+		{
+			Prefix:   "127.0.0.1",
+			Template: "https://storage.example.com/{name}-{version}.{ext}",
+			Unused:   []string{"flavor"},
+		},
+	}
+	if !reflect.DeepEqual(warnings, expected) {
+		t.Errorf("got warnings %#v, want %#v", warnings, expected)
+	}
+}
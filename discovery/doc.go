@@ -14,4 +14,40 @@
 
 // Package discovery contains an experimental implementation of the Image
 // Discovery section of the appc specification.
+//
+// # JSON discovery documents
+//
+// In addition to the HTML meta tags of the specification, a discovery URL
+// can answer with a JSON discovery document, served with the
+// application/json content type, which is easier to serve from object
+// storage or a CDN. It lists, for each prefix, the ac-discovery templates
+// and the ac-discovery-pubkeys URLs of its meta tags:
+//
+//	{
+//	    "prefixes": [
+//	        {
+//	            "prefix": "example.com",
+//	            "ac-discovery": [
+//	                "https://storage.example.com/{os}/{arch}/{name}-{version}.{ext}"
+//	            ],
+//	            "ac-discovery-pubkeys": [
+//	                "https://example.com/pubkeys.gpg"
+//	            ]
+//	        }
+//	    ]
+//	}
+//
+// The document is equivalent to the meta tags, in the same order:
+//
+//	<meta name="ac-discovery" content="example.com https://storage.example.com/{os}/{arch}/{name}-{version}.{ext}">
+//	<meta name="ac-discovery-pubkeys" content="example.com https://example.com/pubkeys.gpg">
+//
+// A host can also serve a single document for all its prefixes at
+// /.well-known/ac-discovery.json, whatever its content type. If the
+// WellKnown option of the Discoverer is set, this document is requested
+// once for all the prefixes of a name, and the discovery URL of a prefix
+// only if the document fails, e.g. with a 404 Not Found, is invalid or has
+// no meta tags for the name.
+// As the endpoints of every prefix matching a name are returned, in the
+// order of the document, it should list the most specific prefixes first.
 package discovery
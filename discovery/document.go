@@ -0,0 +1,187 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/appc/spec/schema/types"
+)
+
+// wellKnownPath is the path of the JSON discovery document of a host.
+const wellKnownPath = "/.well-known/ac-discovery.json"
+
+// jsonDocument is a JSON discovery document, see the package documentation.
+type jsonDocument struct {
+	Prefixes []jsonPrefix `json:"prefixes"`
+}
+
+type jsonPrefix struct {
+	Prefix    string   `json:"prefix"`
+	Templates []string `json:"ac-discovery"`
+	PubKeys   []string `json:"ac-discovery-pubkeys"`
+}
+
+// extractJSONMeta returns the meta tags equivalent to a JSON discovery
+// document, in order.
+func extractJSONMeta(r io.Reader) ([]acMeta, error) {
+	var doc jsonDocument
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	var meta []acMeta
+	for _, p := range doc.Prefixes {
+		if p.Prefix == "" {
+			continue
+		}
+		for _, tpl := range p.Templates {
+			if tpl != "" {
+				meta = append(meta, acMeta{name: "ac-discovery", prefix: p.Prefix, uri: tpl})
+			}
+		}
+		for _, k := range p.PubKeys {
+			if k != "" {
+				meta = append(meta, acMeta{name: "ac-discovery-pubkeys", prefix: p.Prefix, uri: k})
+			}
+		}
+	}
+	return meta, nil
+}
+
+// extractMeta returns the meta tags of the discovery document fetched from
+// urlStr, a JSON document if served at the well-known path or as JSON, an
+// HTML document otherwise.
+func extractMeta(urlStr string, res *http.Response) ([]acMeta, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path != wellKnownPath && !isJSON(res.Header.Get("Content-Type")) {
+		return extractACMeta(res.Body), nil
+	}
+	meta, err := extractJSONMeta(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the JSON discovery document %s: %v", urlStr, err)
+	}
+	return meta, nil
+}
+
+// isJSON returns whether the media type of a Content-Type header is JSON.
+func isJSON(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mt == "application/json" || strings.HasSuffix(mt, "+json")
+}
+
+// wellKnownDocument is the well-known document of the host of a walk,
+// fetched once for all the prefixes.
+type wellKnownDocument struct {
+	once   sync.Once
+	urlStr string
+	meta   []acMeta
+	err    error
+}
+
+// fetch returns the URL and the meta tags of the document, fetching it from
+// urls the first time. The error is an *attemptError.
+func (doc *wellKnownDocument) fetch(ctx context.Context, d *Discoverer, ids *identities, urls []*url.URL) (string, []acMeta, error) {
+	doc.once.Do(func() {
+		doc.urlStr, doc.meta, doc.err = d.fetchMeta(ctx, ids, urls)
+		if _, ok := doc.err.(*attemptError); doc.err != nil && !ok {
+			doc.err = &attemptError{urls: []string{doc.urlStr}, errs: []error{doc.err}}
+		}
+	})
+	return doc.urlStr, doc.meta, doc.err
+}
+
+// wellKnownURLs returns the URLs of the well-known document of the host of
+// name, or nil if it is not requested: without WellKnown, with BaseURL or
+// with a mirror rule.
+func (d *Discoverer) wellKnownURLs(name string, rule *MirrorRule) ([]*url.URL, error) {
+	if !d.WellKnown || d.BaseURL != "" || rule != nil {
+		return nil, nil
+	}
+	host := strings.SplitN(name, "/", 2)[0]
+	if d.Port != 0 {
+		host += ":" + strconv.FormatUint(uint64(d.Port), 10)
+	}
+	schemes := []string{"https"}
+	if d.Insecure&InsecureHTTP != 0 {
+		schemes = append(schemes, "http")
+	}
+	var urls []*url.URL
+	for _, scheme := range schemes {
+		u, err := url.Parse(scheme + "://" + host + wellKnownPath)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// fetchDocument returns the URL and the meta tags of the discovery document
+// of the prefix pre of name: the well-known document of the host if it has
+// meta tags for name, the document of the discovery URLs of pre otherwise.
+// The failures of the well-known document are reported before the ones of
+// the discovery URLs.
+func (d *Discoverer) fetchDocument(ctx context.Context, pre string, name types.ACIdentifier, rule *MirrorRule, w *walk) (string, []acMeta, error) {
+	wkURLs, err := d.wellKnownURLs(pre, rule)
+	if err != nil {
+		return "", nil, err
+	}
+	var wkErr *attemptError
+	if len(wkURLs) != 0 {
+		urlStr, meta, err := w.doc.fetch(ctx, d, &w.ids, wkURLs)
+		if err == nil && hasMetaFor(meta, name) {
+			return urlStr, meta, nil
+		}
+		wkErr, _ = err.(*attemptError)
+	}
+
+	urls, err := d.discoveryURLs(pre, rule)
+	if err != nil {
+		return "", nil, err
+	}
+	urlStr, meta, err := d.fetchMeta(ctx, &w.ids, urls)
+	if aerr, ok := err.(*attemptError); ok && wkErr != nil {
+		err = &attemptError{
+			urls: append(wkErr.urls[:len(wkErr.urls):len(wkErr.urls)], aerr.urls...),
+			errs: append(wkErr.errs[:len(wkErr.errs):len(wkErr.errs)], aerr.errs...),
+		}
+	}
+	return urlStr, meta, err
+}
+
+// hasMetaFor returns whether some of the meta tags are for name.
+func hasMetaFor(meta []acMeta, name types.ACIdentifier) bool {
+	for _, m := range meta {
+		if strings.HasPrefix(name.String(), m.prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+)
+
+const testJSONDocument = `{
+	"prefixes": [
+		{
+			"prefix": "127.0.0.1/myapp",
+			"ac-discovery": ["https://cdn.example.com/{name}-{version}.{ext}"]
+		},
+		{
+			"prefix": "127.0.0.1",
+			"ac-discovery": [
+				"https://storage.example.com/{name}-{version}.{ext}",
+				""
+			],
+			"ac-discovery-pubkeys": ["https://example.com/pubkeys.gpg"]
+		},
+		{
+			"ac-discovery": ["https://ignored.example.com/{name}.{ext}"]
+		}
+	]
+}`
+
+func TestExtractJSONMeta(t *testing.T) {
+	meta, err := extractJSONMeta(strings.NewReader(testJSONDocument))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []acMeta{
+		{"ac-discovery", "127.0.0.1/myapp", "https://cdn.example.com/{name}-{version}.{ext}"},
+		{"ac-discovery", "127.0.0.1", "https://storage.example.com/{name}-{version}.{ext}"},
+		{"ac-discovery-pubkeys", "127.0.0.1", "https://example.com/pubkeys.gpg"},
+	}
+	if !reflect.DeepEqual(meta, expected) {
+		t.Errorf("got meta %#v, want %#v", meta, expected)
+	}
+	if _, err := extractJSONMeta(strings.NewReader(`{"prefixes": {}}`)); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestDiscoverJSONDocument(t *testing.T) {
+	var paths []string
+	var wellKnown, contentType string
+	ts, d := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		switch {
+		case r.URL.Path == wellKnownPath && wellKnown != "":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			fmt.Fprint(w, wellKnown)
+		case r.URL.Path == "/myapp" && contentType != "":
+			w.Header().Set("Content-Type", contentType)
+			fmt.Fprint(w, testJSONDocument)
+		case r.URL.Path == "/":
+			fmt.Fprint(w, testMeta)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer ts.Close()
+	app := App{Name: "127.0.0.1/myapp", Labels: map[types.ACIdentifier]string{"version": "1.0.0"}}
+	cdn := ACIEndpoint{
+		ACI: "https://cdn.example.com/127.0.0.1/myapp-1.0.0.aci",
+		ASC: "https://cdn.example.com/127.0.0.1/myapp-1.0.0.aci.asc",
+	}
+	storage := ACIEndpoint{
+		ACI: "https://storage.example.com/127.0.0.1/myapp-1.0.0.aci",
+		ASC: "https://storage.example.com/127.0.0.1/myapp-1.0.0.aci.asc",
+	}
+
+	tests := []struct {
+		wellKnown   bool
+		document    string
+		contentType string
+		eps         ACIEndpoints
+		paths       []string
+	}{
+		// a JSON document at the discovery URL
+		{false, "", "application/json; charset=utf-8", ACIEndpoints{cdn, storage}, []string{"/myapp"}},
+		{false, "", "application/vnd.ac-discovery+json", ACIEndpoints{cdn, storage}, []string{"/myapp"}},
+		// the well-known document is not requested by default
+		{false, testJSONDocument, "", ACIEndpoints{storage}, []string{"/myapp", "/"}},
+		{true, testJSONDocument, "", ACIEndpoints{cdn, storage}, []string{wellKnownPath}},
+		// the discovery URLs are requested if there is no well-known
+		// document, which is only requested once
+		{true, "", "", ACIEndpoints{storage}, []string{wellKnownPath, "/myapp", "/"}},
+		// or if it has no meta tags for the name
+		{true, `{"prefixes": [{"prefix": "127.0.0.1/other", "ac-discovery": ["https://other.example.com/{name}.{ext}"]}]}`, "",
+			ACIEndpoints{storage}, []string{wellKnownPath, "/myapp", "/"}},
+		// or if it is invalid
+		{true, "<html></html>", "", ACIEndpoints{storage}, []string{wellKnownPath, "/myapp", "/"}},
+	}
+	for i, tt := range tests {
+		paths = nil
+		d.WellKnown, wellKnown, contentType = tt.wellKnown, tt.document, tt.contentType
+		eps, _, err := d.DiscoverACIEndpoints(context.Background(), app)
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(eps, tt.eps) {
+			t.Errorf("#%d: got endpoints %v, want %v", i, eps, tt.eps)
+		}
+		if !reflect.DeepEqual(paths, tt.paths) {
+			t.Errorf("#%d: got requests %v, want %v", i, paths, tt.paths)
+		}
+	}
+
+	// the public keys of the well-known document
+	paths = nil
+	d.WellKnown, wellKnown = true, testJSONDocument
+	keys, _, err := d.DiscoverPublicKeys(context.Background(), app)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(keys, PublicKeys{"https://example.com/pubkeys.gpg"}) {
+		t.Errorf("got public keys %v", keys)
+	}
+
+	// the failures of the well-known document are reported with the ones
+	// of the discovery URLs
+	wellKnown = "<html></html>"
+	app.Name = "127.0.0.1/missing"
+	_, attempts, err := d.DiscoverACIEndpoints(context.Background(), app)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(attempts) != 1 || len(attempts[0].URLs) != 2 || !strings.Contains(attempts[0].Failures[0].Err.Error(), "JSON discovery document") {
+		t.Errorf("got attempts %v, want the error of the well-known document then the 404 of the prefix", attempts)
+	}
+}
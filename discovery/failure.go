@@ -0,0 +1,154 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/url"
+)
+
+// FailureReason is the reason of the failure of a discovery URL.
+type FailureReason int
+
+const (
+	// FailureOther is any other failure, e.g. a refused connection.
+	FailureOther FailureReason = iota
+	// FailureTLS is a TLS handshake failure, e.g. an untrusted certificate.
+	FailureTLS
+	// FailureHTTPStatus is a response with an unexpected status code.
+	FailureHTTPStatus
+	// FailureNoMetaTag is a discovery document without the meta tags
+	// looked for.
+	FailureNoMetaTag
+	// FailureTemplate is a discovery document whose ac-discovery meta tags
+	// could not be rendered, some variables of their template having no
+	// value.
+	FailureTemplate
+	// FailureTimeout is a request which timed out.
+	FailureTimeout
+)
+
+func (r FailureReason) String() string {
+	switch r {
+	case FailureTLS:
+		return "tls error"
+	case FailureHTTPStatus:
+		return "http status"
+	case FailureNoMetaTag:
+		return "no meta tag"
+	case FailureTemplate:
+		return "template error"
+	case FailureTimeout:
+		return "timeout"
+	}
+	return "other"
+}
+
+// Failure is the failure of a discovery URL.
+type Failure struct {
+	URL string
+	// FallbackFrom is the scheme of the URL tried before, if the URL is a
+	// fallback to another scheme, e.g. https for an http URL.
+	FallbackFrom string
+	Reason       FailureReason
+	// StatusCode is the status code of the response, for FailureHTTPStatus.
+	StatusCode int
+	Err        error
+}
+
+// metaError is the error of a discovery document without usable meta tags.
+type metaError struct {
+	reason FailureReason
+	msg    string
+}
+
+func (e *metaError) Error() string {
+	return e.msg
+}
+
+// failureReason classifies the error of a discovery URL, returning the
+// status code of the response for FailureHTTPStatus.
+func failureReason(err error) (FailureReason, int) {
+	var (
+		serr     *statusError
+		merr     *metaError
+		nerr     net.Error
+		operr    *net.OpError
+		rerr     tls.RecordHeaderError
+		perr     *pinError
+		uaerr    x509.UnknownAuthorityError
+		herr     x509.HostnameError
+		invalerr x509.CertificateInvalidError
+	)
+	switch {
+	case errors.As(err, &serr):
+		return FailureHTTPStatus, serr.code
+	case errors.As(err, &merr):
+		return merr.reason, 0
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &nerr) && nerr.Timeout():
+		return FailureTimeout, 0
+	case errors.As(err, &rerr), errors.As(err, &perr),
+		errors.As(err, &uaerr), errors.As(err, &herr), errors.As(err, &invalerr),
+		// an alert sent by the server, e.g. for a missing client
+		// certificate
+		errors.As(err, &operr) && operr.Op == "remote error":
+		return FailureTLS, 0
+	}
+	return FailureOther, 0
+}
+
+// newFailedAttempt returns the failed attempt of a prefix, with the failures
+// of the URLs tried.
+func newFailedAttempt(pre string, dd *Result, err error) FailedAttempt {
+	a := FailedAttempt{Prefix: pre, Error: err}
+	switch e := err.(type) {
+	case *attemptError:
+		a.URLs = e.urls
+		a.Mirror = e.mirror
+		for i, u := range e.urls {
+			f := Failure{URL: u, Err: e.errs[i]}
+			f.Reason, f.StatusCode = failureReason(e.errs[i])
+			if i > 0 {
+				if prev := scheme(e.urls[i-1]); prev != scheme(u) {
+					f.FallbackFrom = prev
+				}
+			}
+			a.Failures = append(a.Failures, f)
+		}
+	case *metaError:
+		a.URLs = []string{dd.URL}
+		a.Failures = []Failure{{URL: dd.URL, Reason: e.reason, Err: e}}
+	}
+	if n := len(a.Failures); n > 0 {
+		a.Reason = a.Failures[n-1].Reason
+	} else {
+		a.Reason, _ = failureReason(err)
+	}
+	return a
+}
+
+// scheme returns the scheme of a URL.
+func scheme(urlStr string) string {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+)
+
+func TestFailedAttempts(t *testing.T) {
+	ts, d := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("X-Test") {
+		case "timeout":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		case "no meta":
+			fmt.Fprint(w, `<html><head></head></html>`)
+		case "template":
+			fmt.Fprint(w, `<meta name="ac-discovery" content="127.0.0.1 https://storage.example.com/{name}-{channel}.{ext}">`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	// silence the handshake errors of the untrusted client
+	ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	defer ts.Close()
+	host := fmt.Sprintf("127.0.0.1:%d", d.Port)
+	app := App{Name: "127.0.0.1", Labels: map[types.ACIdentifier]string{}}
+	httpsURL := "https://" + host + "?ac-discovery=1"
+	httpURL := "http://" + host + "?ac-discovery=1"
+
+	tests := []struct {
+		test     string
+		d        *Discoverer
+		failures []Failure
+	}{
+		{"", d, []Failure{{URL: httpsURL, Reason: FailureHTTPStatus, StatusCode: 404}}},
+		{"timeout", &Discoverer{Client: d.Client, Port: d.Port, Timeout: 50 * time.Millisecond}, []Failure{{URL: httpsURL, Reason: FailureTimeout}}},
+		{"no meta", d, []Failure{{URL: httpsURL, Reason: FailureNoMetaTag}}},
+		{"template", d, []Failure{{URL: httpsURL, Reason: FailureTemplate}}},
+		// the server certificate is not trusted, and the server answers
+		// over HTTP with a 400 Bad Request
+		{
+			"",
+			&Discoverer{Port: d.Port, TLSConfig: &tls.Config{}, Insecure: InsecureHTTP},
+			[]Failure{
+				{URL: httpsURL, Reason: FailureTLS},
+				{URL: httpURL, FallbackFrom: "https", Reason: FailureHTTPStatus, StatusCode: 400},
+			},
+		},
+	}
+	for i, tt := range tests {
+		tt.d.Headers = map[string]http.Header{host: {"X-Test": {tt.test}}}
+		_, attempts, err := tt.d.DiscoverACIEndpoints(context.Background(), app)
+		if err == nil {
+			t.Errorf("#%d: expected an error", i)
+			continue
+		}
+		if len(attempts) != 1 {
+			t.Errorf("#%d: got attempts %v, want one", i, attempts)
+			continue
+		}
+		a := attempts[0]
+		if len(a.Failures) != len(tt.failures) {
+			t.Errorf("#%d: got failures %v, want %v", i, a.Failures, tt.failures)
+			continue
+		}
+		for n, f := range a.Failures {
+			if f.Err == nil {
+				t.Errorf("#%d: failure %d has no error", i, n)
+			}
+			f.Err = nil
+			if f != tt.failures[n] {
+				t.Errorf("#%d: got failure %d %#v, want %#v", i, n, f, tt.failures[n])
+			}
+		}
+		if last := tt.failures[len(tt.failures)-1].Reason; a.Reason != last {
+			t.Errorf("#%d: got reason %v, want %v", i, a.Reason, last)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Fetcher fetches discovery documents for a URL scheme.
+type Fetcher interface {
+	// Fetch performs the request. A document which does not exist is
+	// reported by the status code of the response, not by an error.
+	Fetch(req *http.Request) (*http.Response, error)
+}
+
+// fetcher returns the fetcher of the scheme: the one set in Fetchers, or the
+// HTTP client of the Discoverer for http and https, or a FileFetcher for
+// file.
+func (d *Discoverer) fetcher(scheme string) (Fetcher, error) {
+	if f, ok := d.Fetchers[scheme]; ok {
+		return f, nil
+	}
+	switch scheme {
+	case "https", "http":
+		return httpFetcher{d}, nil
+	case "file":
+		return FileFetcher{}, nil
+	}
+	return nil, fmt.Errorf("unsupported discovery URL scheme %q", scheme)
+}
+
+type httpFetcher struct {
+	d *Discoverer
+}
+
+func (f httpFetcher) Fetch(req *http.Request) (*http.Response, error) {
+	do, err := f.d.doer(req.URL.Host, f.d.Insecure&InsecureTLS != 0)
+	if err != nil {
+		return nil, err
+	}
+	return f.d.authFetch(do, req)
+}
+
+// FileFetcher fetches discovery documents from a local directory tree
+// mirroring a discovery site, using file URLs. The document of a URL whose
+// path is a directory is the index.html, or index.json, file of the
+// directory, otherwise it is the file itself or, if it does not exist, the
+// file with the .html or .json extension added. The query of the URL is
+// ignored.
+type FileFetcher struct{}
+
+func (FileFetcher) Fetch(req *http.Request) (*http.Response, error) {
+	path := filepath.FromSlash(req.URL.Path)
+	candidates := []string{path, path + ".html", path + ".json"}
+	if strings.HasSuffix(req.URL.Path, "/") {
+		candidates = candidates[:1]
+	}
+	for _, p := range candidates {
+		fi, err := os.Stat(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return fileResponse(req, p, fi)
+		}
+		for _, index := range []string{"index.html", "index.json"} {
+			ip := filepath.Join(p, index)
+			if fi, err = os.Stat(ip); os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			return fileResponse(req, ip, fi)
+		}
+	}
+	return newResponse(req, http.StatusNotFound, ioutil.NopCloser(strings.NewReader(""))), nil
+}
+
+// fileResponse returns the response of a file, honoring the
+// If-Modified-Since header of the request.
+func fileResponse(req *http.Request, path string, fi os.FileInfo) (*http.Response, error) {
+	modTime := fi.ModTime().UTC()
+	if t, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil && !modTime.Truncate(1e9).After(t) {
+		return newResponse(req, http.StatusNotModified, ioutil.NopCloser(strings.NewReader(""))), nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	res := newResponse(req, http.StatusOK, f)
+	res.ContentLength = fi.Size()
+	res.Header.Set("Last-Modified", modTime.Format(http.TimeFormat))
+	switch filepath.Ext(path) {
+	case ".html":
+		res.Header.Set("Content-Type", "text/html")
+	case ".json":
+		res.Header.Set("Content-Type", "application/json")
+	}
+	return res, nil
+}
+
+func newResponse(req *http.Request, code int, body io.ReadCloser) *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode: code,
+		Proto:      "HTTP/1.0",
+		ProtoMajor: 1,
+		Header:     http.Header{},
+		Body:       body,
+		Request:    req,
+	}
+}
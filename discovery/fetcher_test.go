@@ -0,0 +1,166 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+)
+
+func TestFileFetcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery-mirror")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for path, content := range map[string]string{
+		"example.com/index.html":       "meta01.html",
+		"example.com/foo.html":         "meta02.html",
+		"example.com/bar/index.html":   "meta03.html",
+		"example.com/bar/baz/qux.html": "meta04.html",
+		"example.com/json.json":        "document.json",
+		"example.com/dir/index.json":   "document.json",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		b, err := ioutil.ReadFile(filepath.Join("testdata", content))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := ioutil.WriteFile(p, b, 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		expected string
+		status   int
+	}{
+		{"example.com", "meta01.html", http.StatusOK},
+		{"example.com/foo", "meta02.html", http.StatusOK},
+		{"example.com/bar", "meta03.html", http.StatusOK},
+		{"example.com/bar/baz", "", http.StatusNotFound},
+		{"example.com/bar/baz/qux", "meta04.html", http.StatusOK},
+		{"example.com/missing", "", http.StatusNotFound},
+		{"example.com/json", "document.json", http.StatusOK},
+		{"example.com/dir", "document.json", http.StatusOK},
+	}
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "file://"+filepath.ToSlash(dir)+"/"+tt.name+"?ac-discovery=1", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		res, err := FileFetcher{}.Fetch(req)
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if res.StatusCode != tt.status {
+			t.Errorf("#%d: got status %d, want %d", i, res.StatusCode, tt.status)
+		}
+		if tt.expected == "" {
+			continue
+		}
+		if ct := res.Header.Get("Content-Type"); isJSON(ct) != strings.HasSuffix(tt.expected, ".json") {
+			t.Errorf("#%d: got content type %q for %s", i, ct, tt.expected)
+		}
+		expected, err := ioutil.ReadFile(filepath.Join("testdata", tt.expected))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(body) != string(expected) {
+			t.Errorf("#%d: got the wrong document for %s", i, tt.name)
+		}
+	}
+
+	// discovery from the mirror, given as a path or as a URL
+	app := App{
+		Name: "example.com/myapp",
+		Labels: map[types.ACIdentifier]string{
+			"version": "1.0.0",
+			"os":      "linux",
+			"arch":    "amd64",
+		},
+	}
+	expected := "https://storage.example.com/example.com/myapp-1.0.0-linux-amd64.aci"
+	for _, base := range []string{dir, "file://" + filepath.ToSlash(dir) + "/"} {
+		d := &Discoverer{BaseURL: base, Cache: NewMemoryCache()}
+		for i := 0; i < 2; i++ {
+			eps, attempts, err := d.DiscoverACIEndpoints(context.Background(), app)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", base, err)
+			}
+			if len(eps) != 1 || eps[0].ACI != expected {
+				t.Errorf("%s: got endpoints %v, want %s", base, eps, expected)
+			}
+			if len(attempts) != 1 || !strings.Contains(attempts[0].Error.Error(), "404") {
+				t.Errorf("%s: got attempts %v, want a 404 for example.com/myapp", base, attempts)
+			}
+		}
+	}
+}
+
+type fetcherFunc func(req *http.Request) (*http.Response, error)
+
+func (f fetcherFunc) Fetch(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestDiscovererFetchers(t *testing.T) {
+	var urls []string
+	d := &Discoverer{
+		BaseURL: "mirror://discovery/sites",
+		Fetchers: map[string]Fetcher{
+			"mirror": fetcherFunc(func(req *http.Request) (*http.Response, error) {
+				urls = append(urls, req.URL.String())
+				return (&mockHTTPDoer{doer: fakeHTTPGet([]meta{{"/sites/example.com", "meta01.html"}}, nil)}).Do(req)
+			}),
+		},
+	}
+	app := App{Name: "example.com/myapp", Labels: map[types.ACIdentifier]string{}}
+	keys, _, err := d.DiscoverPublicKeys(context.Background(), app)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 1 || keys[0] != "https://example.com/pubkeys.gpg" {
+		t.Errorf("got public keys %v", keys)
+	}
+	expected := []string{
+		"mirror://discovery/sites/example.com/myapp?ac-discovery=1",
+		"mirror://discovery/sites/example.com?ac-discovery=1",
+	}
+	if strings.Join(urls, " ") != strings.Join(expected, " ") {
+		t.Errorf("got requests %v, want %v", urls, expected)
+	}
+
+	d = &Discoverer{BaseURL: "ftp://example.com"}
+	if _, _, err := d.DiscoverPublicKeys(context.Background(), app); err == nil || !strings.Contains(err.Error(), "discovery failed") {
+		t.Errorf("got error %v, want discovery to fail", err)
+	}
+}
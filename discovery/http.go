@@ -15,13 +15,16 @@
 package discovery
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -56,76 +59,226 @@ type httpDoer interface {
 }
 
 func init() {
-	t := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		Dial: func(n, a string) (net.Conn, error) {
-			return net.DialTimeout(n, a, defaultDialTimeout)
-		},
-	}
 	Client = &http.Client{
-		Transport: t,
+		Transport: newTransport(nil, defaultDialTimeout, false),
 	}
 	httpDo = Client
 
 	// copy for InsecureTLS
-	tInsecureTLS := http.Transport{
+	ClientInsecureTLS = &http.Client{
+		Transport: newTransport(nil, defaultDialTimeout, true),
+	}
+	httpDoInsecureTLS = ClientInsecureTLS
+}
+
+// newTransport returns a transport using the proxy from the environment,
+// dialing with the given timeout and a copy of tlsConfig, which skips the
+// verification of the server certificates if insecureTLS is set.
+func newTransport(tlsConfig *tls.Config, dialTimeout time.Duration, insecureTLS bool) *http.Transport {
+	if tlsConfig != nil {
+		tlsConfig = tlsConfig.Clone()
+	} else if insecureTLS {
+		tlsConfig = &tls.Config{}
+	}
+	if insecureTLS {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
 		Dial: func(n, a string) (net.Conn, error) {
-			return net.DialTimeout(n, a, defaultDialTimeout)
+			return net.DialTimeout(n, a, dialTimeout)
 		},
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	ClientInsecureTLS = &http.Client{
-		Transport: &tInsecureTLS,
+		TLSClientConfig: tlsConfig,
 	}
-	httpDoInsecureTLS = ClientInsecureTLS
 }
 
 func httpsOrHTTP(name string, hostHeaders map[string]http.Header, insecure InsecureOption, port uint) (urlStr string, body io.ReadCloser, err error) {
-	fetch := func(scheme string, port uint) (urlStr string, res *http.Response, err error) {
+	return newDiscoverer(hostHeaders, insecure, port).httpsOrHTTP(context.Background(), name)
+}
+
+func (d *Discoverer) httpsOrHTTP(ctx context.Context, name string) (urlStr string, body io.ReadCloser, err error) {
+	urls, err := d.discoveryURLs(name, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	urlStr, res, err := d.get(ctx, urls, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return urlStr, res.Body, nil
+}
+
+// statusError is returned when the discovery URL answers with an unexpected
+// status code.
+type statusError struct {
+	code   int
+	header http.Header
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("expected a 200 OK got %d", e.code)
+}
+
+// attemptError is the error of the requests of a discovery document, with
+// the error of each URL tried.
+type attemptError struct {
+	urls   []string
+	errs   []error
+	mirror string
+}
+
+func (e *attemptError) Error() string {
+	if len(e.errs) == 1 {
+		return e.errs[0].Error()
+	}
+	var msgs []string
+	for i, err := range e.errs {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", e.urls[i], err))
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// last returns the error of the last URL tried.
+func (e *attemptError) last() error {
+	return e.errs[len(e.errs)-1]
+}
+
+// discoveryURLs returns the URLs the discovery document of name is fetched
+// from, in order: the mirrors of the rule if any, then, without rule or if
+// it falls back, the HTTPS URL and, if allowed, the HTTP URL, or the URL
+// under BaseURL if set.
+func (d *Discoverer) discoveryURLs(name string, rule *MirrorRule) ([]*url.URL, error) {
+	var urls []*url.URL
+	if rule != nil {
+		mirrors, err := rule.urls(name)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, mirrors...)
+		if !rule.Fallback {
+			return urls, nil
+		}
+	}
+	if d.BaseURL != "" {
+		base, err := parseBaseURL(d.BaseURL)
+		if err != nil {
+			return nil, err
+		}
+		u := *base
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + name
+		u.RawQuery = "ac-discovery=1"
+		return append(urls, &u), nil
+	}
+	schemes := []string{"https"}
+	if d.Insecure&InsecureHTTP != 0 {
+		schemes = append(schemes, "http")
+	}
+	for _, scheme := range schemes {
 		u, err := url.Parse(scheme + "://" + name)
 		if err != nil {
-			return "", nil, err
+			return nil, err
 		}
 		u.RawQuery = "ac-discovery=1"
-		if port != 0 {
-			u.Host += ":" + strconv.FormatUint(uint64(port), 10)
+		if d.Port != 0 {
+			u.Host += ":" + strconv.FormatUint(uint64(d.Port), 10)
 		}
-		urlStr = u.String()
-		req, err := http.NewRequest("GET", urlStr, nil)
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// parseBaseURL parses a base URL, a path without scheme being a local
+// directory.
+func parseBaseURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "" {
+		return u, nil
+	}
+	path, err := filepath.Abs(s)
+	if err != nil {
+		return nil, err
+	}
+	return &url.URL{Scheme: "file", Path: filepath.ToSlash(path)}, nil
+}
+
+// get requests a discovery document from the given URLs until one succeeds,
+// with the host headers. If entry is not nil, the request of entry.URL is
+// made conditional on the entry being modified, and a 304 Not Modified
+// response is accepted from that URL only. The error is an *attemptError.
+func (d *Discoverer) get(ctx context.Context, urls []*url.URL, entry *CacheEntry) (urlStr string, res *http.Response, err error) {
+	fetch := func(u *url.URL, header http.Header) (res *http.Response, err error) {
+		f, err := d.fetcher(u.Scheme)
 		if err != nil {
-			return "", nil, err
+			return nil, err
 		}
-		if hostHeader, ok := hostHeaders[u.Host]; ok {
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if hostHeader, ok := d.Headers[u.Host]; ok {
 			req.Header = hostHeader
 		}
-		if insecure&InsecureTLS != 0 {
-			res, err = httpDoInsecureTLS.Do(req)
-			return
+		if len(header) != 0 {
+			req.Header = req.Header.Clone()
+			for k, v := range header {
+				req.Header[k] = v
+			}
+		}
+		reqCtx, cancel := ctx, context.CancelFunc(func() {})
+		if d.Timeout > 0 {
+			reqCtx, cancel = context.WithTimeout(ctx, d.Timeout)
+		}
+		res, err = f.Fetch(req.WithContext(reqCtx))
+		if err != nil {
+			cancel()
+			return nil, err
 		}
-		res, err = httpDo.Do(req)
-		return
+		// the timeout also covers reading the body
+		res.Body = &cancelReadCloser{res.Body, cancel}
+		return res, nil
 	}
-	closeBody := func(res *http.Response) {
-		if res != nil {
+	ok := func(res *http.Response, header http.Header) bool {
+		return res.StatusCode == http.StatusOK ||
+			(res.StatusCode == http.StatusNotModified && len(header) != 0)
+	}
+	aerr := &attemptError{}
+	for _, u := range urls {
+		if len(aerr.errs) > 0 && ctx.Err() != nil {
+			break
+		}
+		urlStr = u.String()
+		var header http.Header
+		if entry != nil && entry.URL == urlStr {
+			header = entry.validators()
+		}
+		res, err = fetch(u, header)
+		if err == nil && !ok(res, header) {
 			res.Body.Close()
+			err = &statusError{res.StatusCode, res.Header}
 		}
-	}
-	urlStr, res, err := fetch("https", port)
-	if err != nil || res.StatusCode != http.StatusOK {
-		if insecure&InsecureHTTP != 0 {
-			closeBody(res)
-			urlStr, res, err = fetch("http", port)
+		if err == nil {
+			return urlStr, res, nil
 		}
+		aerr.urls = append(aerr.urls, urlStr)
+		aerr.errs = append(aerr.errs, err)
 	}
-
-	if res != nil && res.StatusCode != http.StatusOK {
-		err = fmt.Errorf("expected a 200 OK got %d", res.StatusCode)
+	if len(aerr.errs) == 0 {
+		return "", nil, fmt.Errorf("no discovery URL")
 	}
+	return "", nil, aerr
+}
 
-	if err != nil {
-		closeBody(res)
-		return "", nil, err
-	}
-	return urlStr, res.Body, nil
+// cancelReadCloser cancels the context of a request when its body is closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelReadCloser) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
 }
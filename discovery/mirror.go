@@ -0,0 +1,150 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/appc/spec/schema/types"
+)
+
+// MirrorRule redirects the discovery of the images whose name is Prefix or
+// starts with Prefix followed by a slash.
+type MirrorRule struct {
+	Prefix string `json:"prefix"`
+	// Mirrors are the URL templates of the discovery documents to use
+	// instead of the discovery URLs, tried in order. In each template,
+	// {prefix} is replaced by the prefix being discovered. A template
+	// without scheme is a local path. The ac-discovery=1 query is added to
+	// the HTTP and HTTPS URLs without query.
+	Mirrors []string `json:"mirrors"`
+	// Fallback, if set, tries the discovery URLs after the mirrors.
+	Fallback bool `json:"fallback,omitempty"`
+	// Rewrites rewrite the discovered ACI, signature and public key URLs,
+	// the first one matching being applied.
+	Rewrites []URLRewrite `json:"rewrites,omitempty"`
+}
+
+// URLRewrite replaces the From prefix of a URL by To.
+type URLRewrite struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// MirrorConfig is the content of a mirror configuration file.
+type MirrorConfig struct {
+	Rules []MirrorRule `json:"rules"`
+}
+
+// LoadMirrorRules reads the mirror rules of a JSON mirror configuration file,
+// for example:
+//
+//	{
+//	    "rules": [
+//	        {
+//	            "prefix": "example.com",
+//	            "mirrors": [
+//	                "https://mirror.example.org/discovery/{prefix}",
+//	                "/srv/discovery/{prefix}"
+//	            ],
+//	            "fallback": true,
+//	            "rewrites": [
+//	                {
+//	                    "from": "https://storage.example.com/",
+//	                    "to": "https://mirror.example.org/storage/"
+//	                }
+//	            ]
+//	        }
+//	    ]
+//	}
+func LoadMirrorRules(path string) ([]MirrorRule, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c MirrorConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("error parsing mirror configuration %s: %v", path, err)
+	}
+	for _, r := range c.Rules {
+		if err := r.assertValid(); err != nil {
+			return nil, fmt.Errorf("invalid mirror rule in %s: %v", path, err)
+		}
+	}
+	return c.Rules, nil
+}
+
+func (r *MirrorRule) assertValid() error {
+	if r.Prefix == "" {
+		return fmt.Errorf("prefix is required")
+	}
+	if len(r.Mirrors) == 0 && !r.Fallback {
+		return fmt.Errorf("%s: at least one mirror is required without fallback", r.Prefix)
+	}
+	for _, m := range r.Mirrors {
+		if _, err := parseBaseURL(m); err != nil {
+			return fmt.Errorf("%s: invalid mirror %q: %v", r.Prefix, m, err)
+		}
+	}
+	return nil
+}
+
+// matches returns whether the rule applies to the image name.
+func (r *MirrorRule) matches(name types.ACIdentifier) bool {
+	prefix := strings.TrimSuffix(r.Prefix, "/")
+	return string(name) == prefix || strings.HasPrefix(string(name), prefix+"/")
+}
+
+// urls returns the mirror URLs of the discovery document of pre.
+func (r *MirrorRule) urls(pre string) ([]*url.URL, error) {
+	var urls []*url.URL
+	for _, m := range r.Mirrors {
+		u, err := parseBaseURL(strings.Replace(m, "{prefix}", pre, -1))
+		if err != nil {
+			return nil, err
+		}
+		if (u.Scheme == "https" || u.Scheme == "http") && u.RawQuery == "" {
+			u.RawQuery = "ac-discovery=1"
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// rewrite applies the first matching rewrite to the URL.
+func (r *MirrorRule) rewrite(u string) string {
+	for _, rw := range r.Rewrites {
+		if strings.HasPrefix(u, rw.From) {
+			return rw.To + strings.TrimPrefix(u, rw.From)
+		}
+	}
+	return u
+}
+
+// mirrorRule returns the rule with the longest prefix applying to the image
+// name, or nil if there is none.
+func (d *Discoverer) mirrorRule(name types.ACIdentifier) *MirrorRule {
+	var rule *MirrorRule
+	for i, r := range d.Mirrors {
+		if r.matches(name) && (rule == nil || len(r.Prefix) > len(rule.Prefix)) {
+			rule = &d.Mirrors[i]
+		}
+	}
+	return rule
+}
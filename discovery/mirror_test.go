@@ -0,0 +1,175 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+)
+
+func TestLoadMirrorRules(t *testing.T) {
+	tests := []struct {
+		config string
+		rules  []MirrorRule
+	}{
+		{
+			`{"rules": [{"prefix": "example.com", "mirrors": ["https://mirror.example.org/{prefix}"], "fallback": true}]}`,
+			[]MirrorRule{{Prefix: "example.com", Mirrors: []string{"https://mirror.example.org/{prefix}"}, Fallback: true}},
+		},
+		{
+			`{"rules": [{"prefix": "example.com", "fallback": true, "rewrites": [{"from": "https://a/", "to": "https://b/"}]}]}`,
+			[]MirrorRule{{Prefix: "example.com", Fallback: true, Rewrites: []URLRewrite{{"https://a/", "https://b/"}}}},
+		},
+		// invalid configurations
+		{`{"rules": [{"mirrors": ["https://mirror.example.org/{prefix}"]}]}`, nil},
+		{`{"rules": [{"prefix": "example.com"}]}`, nil},
+		{`{"rules": [{"prefix": "example.com", "mirrors": ["%zz"]}]}`, nil},
+		{`{"rules": `, nil},
+	}
+	dir, err := ioutil.TempDir("", "discovery-mirror")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mirrors.json")
+	for i, tt := range tests {
+		if err := ioutil.WriteFile(path, []byte(tt.config), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		rules, err := LoadMirrorRules(path)
+		if tt.rules == nil {
+			if err == nil {
+				t.Errorf("#%d: expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(rules, tt.rules) {
+			t.Errorf("#%d: got rules %#v, want %#v", i, rules, tt.rules)
+		}
+	}
+}
+
+func TestDiscoverMirrors(t *testing.T) {
+	var urls []string
+	mirror := fakeHTTPGet([]meta{{"/mirror/example.com", "meta01.html"}}, nil)
+	origin := fakeHTTPGet([]meta{{"/myapp", "meta04.html"}}, nil)
+	d := &Discoverer{
+		Fetchers: map[string]Fetcher{
+			"https": fetcherFunc(func(req *http.Request) (*http.Response, error) {
+				urls = append(urls, req.URL.String())
+				if req.URL.Host == "mirror.example.org" {
+					return mirror(req)
+				}
+				return origin(req)
+			}),
+		},
+		Mirrors: []MirrorRule{
+			{
+				Prefix:   "example.com",
+				Mirrors:  []string{"https://mirror.example.org/mirror/{prefix}"},
+				Fallback: true,
+				Rewrites: []URLRewrite{
+					{From: "https://storage.example.com/", To: "https://mirror.example.org/storage/"},
+					{From: "https://", To: "http://"},
+				},
+			},
+			{
+				Prefix:  "example.com/other",
+				Mirrors: []string{"https://mirror.example.org/other/{prefix}"},
+			},
+		},
+	}
+	app := App{
+		Name: "example.com/myapp",
+		Labels: map[types.ACIdentifier]string{
+			"version": "1.0.0",
+			"os":      "linux",
+			"arch":    "amd64",
+		},
+	}
+
+	// the mirror fails for example.com/myapp, the origin succeeds
+	eps, attempts, err := d.DiscoverACIEndpoints(context.Background(), app)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// only the first matching rewrite applies
+	expected := "http://another.storage.example.com/example.com/myapp-1.0.0-linux-amd64.aci"
+	if len(eps) != 1 || eps[0].ACI != expected {
+		t.Errorf("got endpoints %v, want %s", eps, expected)
+	}
+	if len(attempts) != 0 {
+		t.Errorf("got attempts %v, want none", attempts)
+	}
+	expectedURLs := []string{
+		"https://mirror.example.org/mirror/example.com/myapp?ac-discovery=1",
+		"https://example.com/myapp?ac-discovery=1",
+	}
+	if !reflect.DeepEqual(urls, expectedURLs) {
+		t.Errorf("got requests %v, want %v", urls, expectedURLs)
+	}
+
+	// the mirror succeeds for example.com after the walk
+	urls = nil
+	app.Name = "example.com/foo"
+	eps, attempts, err = d.DiscoverACIEndpoints(context.Background(), app)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = "https://mirror.example.org/storage/example.com/foo-1.0.0-linux-amd64.aci"
+	if len(eps) != 1 || eps[0].ACI != expected {
+		t.Errorf("got endpoints %v, want %s", eps, expected)
+	}
+	if len(attempts) != 1 || attempts[0].Mirror != "example.com" || len(attempts[0].URLs) != 2 {
+		t.Errorf("got attempts %#v, want a failure of the mirror and the origin", attempts)
+	}
+
+	// the longest prefix applies, without fallback
+	urls = nil
+	app.Name = "example.com/other"
+	if _, attempts, err = d.DiscoverACIEndpoints(context.Background(), app); err == nil {
+		t.Errorf("expected an error")
+	}
+	expectedURLs = []string{
+		"https://mirror.example.org/other/example.com/other?ac-discovery=1",
+		"https://mirror.example.org/other/example.com?ac-discovery=1",
+	}
+	if !reflect.DeepEqual(urls, expectedURLs) {
+		t.Errorf("got requests %v, want %v", urls, expectedURLs)
+	}
+	for _, a := range attempts {
+		if a.Mirror != "example.com/other" {
+			t.Errorf("got attempt %#v, want the mirror rule example.com/other", a)
+		}
+	}
+
+	// a prefix only matches whole path components
+	urls = nil
+	app.Name = "example.community/app"
+	d.DiscoverACIEndpoints(context.Background(), app)
+	if len(urls) == 0 || urls[0] != "https://example.community/app?ac-discovery=1" {
+		t.Errorf("got requests %v, want no mirror", urls)
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+)
+
+// HostTLSConfig is the TLS configuration of the requests to a host, added to
+// the TLS configuration of the Discoverer.
+type HostTLSConfig struct {
+	// RootCAs are trusted in addition to the system roots, or to the roots
+	// of the TLS configuration of the Discoverer.
+	RootCAs []*x509.Certificate
+	// Certificates are the client certificates presented to the host.
+	Certificates []tls.Certificate
+	// PinnedKeys, if not empty, are the pins of the public keys accepted
+	// from the host, as returned by PublicKeyPin: the certificate chain of
+	// the host must contain one of them.
+	PinnedKeys []string
+}
+
+// PublicKeyPin returns the pin of the public key of a certificate, the
+// base64 encoded sha256 hash of its SubjectPublicKeyInfo, as in HTTP Public
+// Key Pinning.
+func PublicKeyPin(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// LoadCertificates reads the certificates of a PEM file, like a CA bundle.
+func LoadCertificates(path string) ([]*x509.Certificate, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing a certificate of %s: %v", path, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return certs, nil
+}
+
+// apply returns a copy of the TLS configuration with the host configuration
+// added, for the requests to host, skipping the verification of the
+// certificates if insecureTLS is set.
+func (h *HostTLSConfig) apply(base *tls.Config, host string, insecureTLS bool) (*tls.Config, error) {
+	c := &tls.Config{}
+	if base != nil {
+		c = base.Clone()
+	}
+	if insecureTLS {
+		c.InsecureSkipVerify = true
+	}
+	serverName := c.ServerName
+	if serverName == "" {
+		serverName = host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			serverName = h
+		}
+	}
+	var roots *x509.CertPool
+	if len(h.RootCAs) != 0 && !c.InsecureSkipVerify {
+		if c.RootCAs == nil {
+			// a copy of the system roots
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				return nil, err
+			}
+			for _, ca := range h.RootCAs {
+				pool.AddCert(ca)
+			}
+			c.RootCAs = pool
+		} else {
+			// A CertPool cannot be copied, so the chain is verified by
+			// VerifyPeerCertificate against the roots of base, then
+			// against the roots of the host.
+			roots = c.RootCAs
+			c.InsecureSkipVerify = true
+		}
+	}
+	c.Certificates = append(c.Certificates[:len(c.Certificates):len(c.Certificates)], h.Certificates...)
+	if roots != nil || len(h.PinnedKeys) != 0 {
+		// VerifyPeerCertificate is not called for resumed sessions
+		c.ClientSessionCache = nil
+		verify := c.VerifyPeerCertificate
+		c.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+			certs, err := parseCertificates(rawCerts)
+			if err != nil {
+				return err
+			}
+			if roots != nil {
+				if chains, err = h.verifyChains(certs, roots, serverName); err != nil {
+					return err
+				}
+			}
+			if verify != nil {
+				if err := verify(rawCerts, chains); err != nil {
+					return err
+				}
+			}
+			return h.verifyPins(serverName, certs, chains)
+		}
+	}
+	return c, nil
+}
+
+func parseCertificates(rawCerts [][]byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate presented")
+	}
+	return certs, nil
+}
+
+// verifyChains verifies the certificates presented by the server against
+// roots, then against the roots of the host, returning the error of the
+// first verification if both fail.
+func (h *HostTLSConfig) verifyChains(certs []*x509.Certificate, roots *x509.CertPool, serverName string) ([][]*x509.Certificate, error) {
+	opts := x509.VerifyOptions{DNSName: serverName, Roots: roots, Intermediates: x509.NewCertPool()}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	chains, err := certs[0].Verify(opts)
+	if err == nil {
+		return chains, nil
+	}
+	opts.Roots = x509.NewCertPool()
+	for _, ca := range h.RootCAs {
+		opts.Roots.AddCert(ca)
+	}
+	if chains, herr := certs[0].Verify(opts); herr == nil {
+		return chains, nil
+	}
+	return nil, err
+}
+
+// verifyPins checks that the verified chains, or the certificates presented
+// if they are not verified, contain a pinned key.
+func (h *HostTLSConfig) verifyPins(serverName string, certs []*x509.Certificate, chains [][]*x509.Certificate) error {
+	if len(h.PinnedKeys) == 0 {
+		return nil
+	}
+	if len(chains) == 0 {
+		chains = [][]*x509.Certificate{certs}
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			pin := PublicKeyPin(cert)
+			for _, p := range h.PinnedKeys {
+				if p == pin {
+					return nil
+				}
+			}
+		}
+	}
+	return &pinError{serverName}
+}
+
+// pinError is returned when the certificate chain of a host has no pinned
+// key.
+type pinError struct {
+	host string
+}
+
+func (e *pinError) Error() string {
+	return fmt.Sprintf("no pinned public key in the certificate chain of %s", e.host)
+}
+
+// hostTLS returns the TLS configuration of the host, looked up with its
+// port, then without, then with "*", or nil if it has none.
+func (d *Discoverer) hostTLS(host string) *HostTLSConfig {
+	keys := []string{host}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		keys = append(keys, h)
+	}
+	for _, k := range append(keys, "*") {
+		if c, ok := d.HostTLS[k]; ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// newHostDoer returns a client for a host with its own TLS configuration,
+// using a copy of the transport of Client if set.
+func (d *Discoverer) newHostDoer(host string, hc *HostTLSConfig, insecureTLS bool) (httpDoer, error) {
+	c := &http.Client{}
+	var t *http.Transport
+	if d.Client != nil {
+		*c = *d.Client
+		rt := c.Transport
+		if rt == nil {
+			rt = http.DefaultTransport
+		}
+		ht, ok := rt.(*http.Transport)
+		if !ok {
+			return nil, fmt.Errorf("a host TLS configuration requires the transport of the client to be an http.Transport")
+		}
+		t = ht.Clone()
+	} else {
+		dialTimeout := d.DialTimeout
+		if dialTimeout == 0 {
+			dialTimeout = defaultDialTimeout
+		}
+		t = newTransport(d.TLSConfig, dialTimeout, false)
+	}
+	tlsConfig, err := hc.apply(t.TLSClientConfig, host, insecureTLS)
+	if err != nil {
+		return nil, err
+	}
+	t.TLSClientConfig = tlsConfig
+	c.Transport = t
+	return c, nil
+}
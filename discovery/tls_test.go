@@ -0,0 +1,234 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+)
+
+// newClientCertificate returns a self-signed client certificate.
+func newClientCertificate(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "discovery client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func TestDiscoverHostTLS(t *testing.T) {
+	clientCert, clientX509 := newClientCertificate(t)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testMeta)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientX509)
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	// silence the handshake errors of the failing tests
+	ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	ts.StartTLS()
+	defer ts.Close()
+	port := serverPort(t, ts)
+	host := fmt.Sprintf("127.0.0.1:%d", port)
+
+	app := App{Name: "127.0.0.1", Labels: map[types.ACIdentifier]string{}}
+	tests := []struct {
+		hostTLS map[string]*HostTLSConfig
+		ok      bool
+	}{
+		// no client certificate
+		{
+			map[string]*HostTLSConfig{"127.0.0.1": {RootCAs: []*x509.Certificate{ts.Certificate()}}},
+			false,
+		},
+		// unknown server CA
+		{
+			map[string]*HostTLSConfig{"*": {Certificates: []tls.Certificate{clientCert}}},
+			false,
+		},
+		{
+			map[string]*HostTLSConfig{"*": {
+				RootCAs:      []*x509.Certificate{ts.Certificate()},
+				Certificates: []tls.Certificate{clientCert},
+			}},
+			true,
+		},
+		// the configuration of another host does not apply
+		{
+			map[string]*HostTLSConfig{"example.com": {
+				RootCAs:      []*x509.Certificate{ts.Certificate()},
+				Certificates: []tls.Certificate{clientCert},
+			}},
+			false,
+		},
+		{
+			map[string]*HostTLSConfig{host: {
+				RootCAs:      []*x509.Certificate{ts.Certificate()},
+				Certificates: []tls.Certificate{clientCert},
+				PinnedKeys:   []string{PublicKeyPin(ts.Certificate())},
+			}},
+			true,
+		},
+		{
+			map[string]*HostTLSConfig{host: {
+				RootCAs:      []*x509.Certificate{ts.Certificate()},
+				Certificates: []tls.Certificate{clientCert},
+				PinnedKeys:   []string{PublicKeyPin(clientX509)},
+			}},
+			false,
+		},
+	}
+	for i, tt := range tests {
+		d := &Discoverer{TLSConfig: &tls.Config{}, HostTLS: tt.hostTLS, Port: port}
+		_, attempts, err := d.DiscoverPublicKeys(context.Background(), app)
+		if tt.ok && err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("#%d: expected an error", i)
+		}
+		if !tt.ok && (len(attempts) != 1 || attempts[0].Reason != FailureTLS) {
+			t.Errorf("#%d: got attempts %v, want a TLS failure", i, attempts)
+		}
+	}
+
+	// the host roots are added to the roots of the TLS configuration
+	for i, hostRoots := range [][]*x509.Certificate{nil, {ts.Certificate()}} {
+		d := &Discoverer{
+			HostTLS: map[string]*HostTLSConfig{"*": {
+				RootCAs:      hostRoots,
+				Certificates: []tls.Certificate{clientCert},
+			}},
+			TLSConfig: &tls.Config{RootCAs: x509.NewCertPool()},
+			Port:      port,
+		}
+		_, attempts, err := d.DiscoverPublicKeys(context.Background(), app)
+		if ok := hostRoots != nil; ok && err != nil {
+			t.Errorf("roots #%d: unexpected error: %v", i, err)
+		} else if !ok && (err == nil || len(attempts) != 1 || attempts[0].Reason != FailureTLS) {
+			t.Errorf("roots #%d: got error %v, attempts %v, want a TLS failure", i, err, attempts)
+		}
+	}
+
+	// pinned keys are checked on resumed sessions too: a session cached by
+	// a connection without pins is not reused
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	base := &tls.Config{
+		RootCAs:            roots,
+		Certificates:       []tls.Certificate{clientCert},
+		ClientSessionCache: tls.NewLRUClientSessionCache(8),
+	}
+	for i, pins := range [][]string{nil, {PublicKeyPin(clientX509)}} {
+		hostTLS := map[string]*HostTLSConfig{"*": {PinnedKeys: pins}}
+		if pins == nil {
+			hostTLS = nil
+		}
+		d := &Discoverer{TLSConfig: base, HostTLS: hostTLS, Port: port}
+		_, attempts, err := d.DiscoverPublicKeys(context.Background(), app)
+		if pins == nil && err != nil {
+			t.Fatalf("session #%d: unexpected error: %v", i, err)
+		}
+		if pins != nil && (err == nil || len(attempts) != 1 || attempts[0].Reason != FailureTLS) {
+			t.Errorf("session #%d: got error %v, attempts %v, want a pinning failure", i, err, attempts)
+		}
+	}
+
+	// pinned keys are checked without verification too
+	d := &Discoverer{
+		HostTLS: map[string]*HostTLSConfig{"*": {
+			Certificates: []tls.Certificate{clientCert},
+			PinnedKeys:   []string{PublicKeyPin(clientX509)},
+		}},
+		TLSConfig: &tls.Config{},
+		Port:      port,
+		Insecure:  InsecureTLS,
+	}
+	_, attempts, err := d.DiscoverPublicKeys(context.Background(), app)
+	if err == nil || len(attempts) != 1 || !strings.Contains(attempts[0].Error.Error(), "no pinned public key") {
+		t.Errorf("got error %v, attempts %v, want a pinning failure", err, attempts)
+	}
+}
+
+func TestLoadCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery-tls")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	_, cert1 := newClientCertificate(t)
+	_, cert2 := newClientCertificate(t)
+	var bundle []byte
+	for _, c := range []*x509.Certificate{cert1, cert2} {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("ignored")})...)
+
+	path := filepath.Join(dir, "bundle.pem")
+	if err := ioutil.WriteFile(path, bundle, 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	certs, err := LoadCertificates(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(certs) != 2 || !certs[0].Equal(cert1) || !certs[1].Equal(cert2) {
+		t.Errorf("got %d certificates, want the 2 of the bundle", len(certs))
+	}
+
+	if err := ioutil.WriteFile(path, []byte("not a certificate"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := LoadCertificates(path); err == nil {
+		t.Errorf("expected an error without certificates")
+	}
+}
@@ -22,7 +22,9 @@ import (
 	"io"
 	"io/ioutil"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/appc/spec/schema"
 	"github.com/appc/spec/schema/types"
@@ -56,6 +58,9 @@ type Image struct {
 	Im    *schema.ImageManifest
 	Key   string
 	Level uint16
+	// Size is the expected size of the uncompressed ACI, taken from the
+	// dependency pointing to the image. Zero means it is unknown.
+	Size uint64
 }
 
 // Images encapsulates an ordered slice of Image structs. It represents a flat
@@ -70,6 +75,10 @@ type Images []Image
 type ACIFiles struct {
 	Key     string
 	FileMap map[string]struct{}
+	// LinkTargets contains the files which are not extracted from this ACI
+	// but are the target of hard links in FileMap. Their contents are
+	// needed to render these hard links.
+	LinkTargets map[string]struct{}
 }
 
 // RenderedACI is an (ordered) slice of ACIFiles
@@ -100,23 +109,77 @@ func GetRenderedACI(name types.ACIdentifier, labels types.Labels, ap ACIRegistry
 // GetRenderedACIFromList returns the RenderedACI list. All file outside rootfs
 // are excluded (at the moment only "manifest").
 func GetRenderedACIFromList(imgs Images, ap ACIProvider) (RenderedACI, error) {
+	return getRenderedACIFromList(imgs, ap, nil, 1)
+}
+
+// GetRenderedACIFromListWithProvenance returns the RenderedACI list like
+// GetRenderedACIFromList and the Provenance of every file of the images.
+func GetRenderedACIFromListWithProvenance(imgs Images, ap ACIProvider) (RenderedACI, Provenance, error) {
+	prov := make(Provenance)
+	renderedACI, err := getRenderedACIFromList(imgs, ap, prov, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	return renderedACI, prov, nil
+}
+
+// GetRenderedACIFromListConcurrent returns the RenderedACI list like
+// GetRenderedACIFromList, reading and verifying up to parallelism ACIs at the
+// same time. If parallelism is less than 1, the number of CPUs is used. The
+// ACIProvider must support concurrent calls to ReadStream.
+//
+// The result does not depend on parallelism: only the scanning of the ACIs
+// is concurrent, the files are then selected in the order of the images.
+func GetRenderedACIFromListConcurrent(imgs Images, ap ACIProvider, parallelism int) (RenderedACI, error) {
+	if parallelism < 1 {
+		parallelism = runtime.NumCPU()
+	}
+	return getRenderedACIFromList(imgs, ap, nil, parallelism)
+}
+
+// getRenderedACIFromList returns the RenderedACI list, scanning up to
+// parallelism ACIs at the same time and recording the provenance of the
+// files in prov if it is not nil.
+func getRenderedACIFromList(imgs Images, ap ACIProvider, prov Provenance, parallelism int) (RenderedACI, error) {
 	if len(imgs) == 0 {
 		return nil, fmt.Errorf("image list empty")
 	}
 
+	// With a parallelism of one, the images are scanned one at a time,
+	// only keeping the scan of the image being processed.
+	var scans []*aciScan
+	if parallelism > 1 {
+		var err error
+		if scans, err = scanACIs(imgs, ap, parallelism); err != nil {
+			return nil, err
+		}
+	}
+
 	allFiles := make(map[string]byte)
 	renderedACI := RenderedACI{}
 
 	first := true
 	for i, img := range imgs {
-		pwlm := getUpperPWLM(imgs, i)
-		ra, err := getACIFiles(img, ap, allFiles, pwlm)
-		if err != nil {
-			return nil, err
+		var scan *aciScan
+		if scans != nil {
+			// a repeated image is only scanned once, with the
+			// expected size of its first occurrence.
+			scan = scans[i]
+			if err := checkSize(img, scan); err != nil {
+				return nil, err
+			}
+		} else {
+			var err error
+			if scan, err = scanACI(img, ap); err != nil {
+				return nil, err
+			}
 		}
+		pwlm := getUpperPWLM(imgs, i)
+		ra := getACIFiles(img, scan, allFiles, pwlm, prov)
 		// Use the manifest from the upper ACI
 		if first {
 			ra.FileMap["manifest"] = struct{}{}
+			prov.provide("manifest", img)
 			first = false
 		}
 		renderedACI = append(renderedACI, ra)
@@ -125,6 +188,41 @@ func GetRenderedACIFromList(imgs Images, ap ACIProvider) (RenderedACI, error) {
 	return renderedACI, nil
 }
 
+// scanACIs scans the given images, up to parallelism at the same time. An
+// image repeated in the list is only scanned once. If more than one scan
+// fails, the error of the first image is returned.
+func scanACIs(imgs Images, ap ACIProvider, parallelism int) ([]*aciScan, error) {
+	scans := make([]*aciScan, len(imgs))
+	errs := make([]error, len(imgs))
+	firsts := make(map[string]int)
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, img := range imgs {
+		if _, ok := firsts[img.Key]; ok {
+			continue
+		}
+		firsts[img.Key] = i
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, img Image) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			scans[i], errs[i] = scanACI(img, ap)
+		}(i, img)
+	}
+	wg.Wait()
+	for i, img := range imgs {
+		first := firsts[img.Key]
+		if errs[first] != nil {
+			return nil, errs[first]
+		}
+		scans[i] = scans[first]
+	}
+	return scans, nil
+}
+
 // getUpperPWLM returns the pwl at the lower level for the branch where
 // img[pos] lives.
 func getUpperPWLM(imgs Images, pos int) map[string]struct{} {
@@ -141,82 +239,169 @@ func getUpperPWLM(imgs Images, pos int) map[string]struct{} {
 	return pwlm
 }
 
-// getACIFiles returns the ACIFiles struct for the given image. All files
-// outside rootfs are excluded (at the moment only "manifest").
-func getACIFiles(img Image, ap ACIProvider, allFiles map[string]byte, pwlm map[string]struct{}) (*ACIFiles, error) {
+// An aciScan lists the entries of an ACI, in the order of its tar stream.
+type aciScan struct {
+	entries []scanEntry
+	// size is the size of the uncompressed ACI.
+	size uint64
+}
+
+type scanEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+}
+
+// scanACI reads the ACI of the given image, verifying its hash.
+func scanACI(img Image, ap ACIProvider) (*aciScan, error) {
 	rs, err := ap.ReadStream(img.Key)
 	if err != nil {
 		return nil, err
 	}
 	defer rs.Close()
 
+	// Do not read endless data when the size is known: one more byte is
+	// enough to detect a mismatch.
+	var sr io.Reader = rs
+	if img.Size != 0 {
+		sr = io.LimitReader(rs, int64(img.Size)+1)
+	}
 	hash := sha512.New()
-	r := io.TeeReader(rs, hash)
+	cr := &countingReader{r: sr}
+	r := io.TeeReader(cr, hash)
 
+	scan := &aciScan{}
+	if err = Walk(tar.NewReader(r), func(hdr *tar.Header) error {
+		scan.entries = append(scan.entries, scanEntry{
+			name:     filepath.Clean(hdr.Name),
+			typeflag: hdr.Typeflag,
+			linkname: hdr.Linkname,
+		})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Tar does not necessarily read the complete file, so ensure we read the entirety into the hash
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return nil, fmt.Errorf("error reading ACI: %v", err)
+	}
+
+	scan.size = cr.n
+	if err := checkSize(img, scan); err != nil {
+		return nil, err
+	}
+	if g := ap.HashToKey(hash); g != img.Key {
+		return nil, fmt.Errorf("image hash does not match expected (%s != %s)", g, img.Key)
+	}
+	return scan, nil
+}
+
+// checkSize returns an error if the scanned ACI does not have the expected
+// size of the image.
+func checkSize(img Image, scan *aciScan) error {
+	if img.Size != 0 && scan.size != img.Size {
+		return fmt.Errorf("image %s size does not match expected (%d != %d)", img.Key, scan.size, img.Size)
+	}
+	return nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += uint64(n)
+	return n, err
+}
+
+// getACIFiles returns the ACIFiles struct for the given image. All files
+// outside rootfs are excluded (at the moment only "manifest"). If prov is not
+// nil, the provenance of the files of the image is recorded in it.
+func getACIFiles(img Image, scan *aciScan, allFiles map[string]byte, pwlm map[string]struct{}, prov Provenance) *ACIFiles {
 	thispwlm := pwlToMap(img.Im.PathWhitelist)
 	ra := &ACIFiles{FileMap: make(map[string]struct{})}
-	if err = Walk(tar.NewReader(r), func(hdr *tar.Header) error {
-		name := hdr.Name
-		cleanName := filepath.Clean(name)
+	var linkTargets []string
+	for _, e := range scan.entries {
+		cleanName := e.name
 
 		// Add the rootfs directory.
-		if cleanName == "rootfs" && hdr.Typeflag == tar.TypeDir {
+		if cleanName == "rootfs" && e.typeflag == tar.TypeDir {
 			ra.FileMap[cleanName] = struct{}{}
-			allFiles[cleanName] = hdr.Typeflag
-			return nil
+			if _, ok := allFiles[cleanName]; ok {
+				prov.drop(cleanName, img, DropAlreadyProvided)
+			} else {
+				prov.provide(cleanName, img)
+			}
+			allFiles[cleanName] = e.typeflag
+			continue
 		}
 
 		// Ignore files outside /rootfs/ (at the moment only "manifest").
 		if !strings.HasPrefix(cleanName, "rootfs/") {
-			return nil
+			continue
 		}
 
 		// Is the file in our PathWhiteList?
 		// If the file is a directory continue also if not in PathWhiteList
-		if hdr.Typeflag != tar.TypeDir {
+		if e.typeflag != tar.TypeDir {
 			if len(img.Im.PathWhitelist) > 0 {
 				if _, ok := thispwlm[cleanName]; !ok {
-					return nil
+					prov.drop(cleanName, img, DropPathWhitelist)
+					continue
 				}
 			}
 		}
 		// Is the file in the lower level PathWhiteList of this img branch?
 		if pwlm != nil {
 			if _, ok := pwlm[cleanName]; !ok {
-				return nil
+				prov.drop(cleanName, img, DropPathWhitelist)
+				continue
 			}
 		}
 		// Is the file already provided by a previous image?
 		if _, ok := allFiles[cleanName]; ok {
-			return nil
+			prov.drop(cleanName, img, DropAlreadyProvided)
+			continue
 		}
 		// Check that the parent dirs are also of type dir in the upper
 		// images
+		parentNotDir := false
 		parentDir := filepath.Dir(cleanName)
 		for parentDir != "." && parentDir != "/" {
 			if ft, ok := allFiles[parentDir]; ok && ft != tar.TypeDir {
-				return nil
+				parentNotDir = true
+				break
 			}
 			parentDir = filepath.Dir(parentDir)
 		}
+		if parentNotDir {
+			prov.drop(cleanName, img, DropParentNotDir)
+			continue
+		}
 		ra.FileMap[cleanName] = struct{}{}
-		allFiles[cleanName] = hdr.Typeflag
-		return nil
-	}); err != nil {
-		return nil, err
-	}
-
-	// Tar does not necessarily read the complete file, so ensure we read the entirety into the hash
-	if _, err := io.Copy(ioutil.Discard, r); err != nil {
-		return nil, fmt.Errorf("error reading ACI: %v", err)
+		allFiles[cleanName] = e.typeflag
+		prov.provide(cleanName, img)
+		if e.typeflag == tar.TypeLink {
+			linkTargets = append(linkTargets, filepath.Clean(e.linkname))
+		}
 	}
 
-	if g := ap.HashToKey(hash); g != img.Key {
-		return nil, fmt.Errorf("image hash does not match expected (%s != %s)", g, img.Key)
+	for _, target := range linkTargets {
+		if _, ok := ra.FileMap[target]; ok {
+			continue
+		}
+		if ra.LinkTargets == nil {
+			ra.LinkTargets = make(map[string]struct{})
+		}
+		ra.LinkTargets[target] = struct{}{}
 	}
 
 	ra.Key = img.Key
-	return ra, nil
+	return ra
 }
 
 // pwlToMap converts a pathWhiteList slice to a map for faster search
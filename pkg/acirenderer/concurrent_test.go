@@ -0,0 +1,131 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acirenderer
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+)
+
+func TestGetRenderedACIFromListConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", tstprefix)
+	if err != nil {
+		t.Fatalf("error creating tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ds := NewTestStore()
+
+	appKey, _ := newLinkTestImages(t, dir, ds)
+	h, _ := types.NewHash(appKey)
+	imgs, err := CreateDepListFromImageID(*h, ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// A repeated image is shadowed by its first occurrence.
+	imgs = append(imgs, imgs[1])
+
+	expected, err := GetRenderedACIFromList(imgs, ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, parallelism := range []int{0, 1, 2, 8} {
+		renderedACI, err := GetRenderedACIFromListConcurrent(imgs, ds, parallelism)
+		if err != nil {
+			t.Fatalf("parallelism %d: unexpected error: %v", parallelism, err)
+		}
+		if !reflect.DeepEqual(renderedACI, expected) {
+			t.Errorf("parallelism %d: rendered image differs from the sequential one", parallelism)
+		}
+	}
+
+	// A corrupted image is detected.
+	aci := ds.acis[imgs[1].Key]
+	data := aci.data
+	aci.data = append(append([]byte{}, data...), make([]byte, 1024)...)
+	defer func() { aci.data = data }()
+	if _, err := GetRenderedACIFromListConcurrent(imgs, ds, 2); err == nil || !strings.Contains(err.Error(), "image hash does not match") {
+		t.Errorf("got error %v, want a hash mismatch", err)
+	}
+}
+
+// newBenchmarkImages creates an image with the given number of dependencies,
+// each having a file of the given size, and returns its dependency list.
+func newBenchmarkImages(b *testing.B, dir string, ds *TestStore, deps int, size int) Images {
+	contents := strings.Repeat("x", size)
+	imj := `{"acKind": "ImageManifest", "acVersion": "0.8.11", "name": "example.com/app"}`
+	for i := 0; i < deps; i++ {
+		depj := fmt.Sprintf(`{"acKind": "ImageManifest", "acVersion": "0.8.11", "name": "example.com/dep%d"}`, i)
+		entries := []*testTarEntry{
+			{contents: depj, header: &tar.Header{Name: "manifest", Size: int64(len(depj))}},
+			{header: &tar.Header{Name: "rootfs", Typeflag: tar.TypeDir}},
+			{contents: contents, header: &tar.Header{Name: fmt.Sprintf("rootfs/file%d", i), Size: int64(size)}},
+			{contents: contents, header: &tar.Header{Name: "rootfs/shared", Size: int64(size)}},
+		}
+		key, err := newTestACI(entries, dir, ds)
+		if err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+		h, _ := types.NewHash(key)
+		imj, err = addDependencies(imj, types.Dependency{ImageName: types.ACIdentifier(fmt.Sprintf("example.com/dep%d", i)), ImageID: h})
+		if err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+	}
+	entries := []*testTarEntry{
+		{contents: imj, header: &tar.Header{Name: "manifest", Size: int64(len(imj))}},
+	}
+	key, err := newTestACI(entries, dir, ds)
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	h, _ := types.NewHash(key)
+	imgs, err := CreateDepListFromImageID(*h, ds)
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	return imgs
+}
+
+func BenchmarkGetRenderedACIFromList(b *testing.B) {
+	dir, err := ioutil.TempDir("", tstprefix)
+	if err != nil {
+		b.Fatalf("error creating tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ds := NewTestStore()
+	imgs := newBenchmarkImages(b, dir, ds, 16, 1<<20)
+
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := GetRenderedACIFromList(imgs, ds); err != nil {
+				b.Fatalf("unexpected error: %v", err)
+			}
+		}
+	})
+	b.Run("concurrent", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := GetRenderedACIFromListConcurrent(imgs, ds, 0); err != nil {
+				b.Fatalf("unexpected error: %v", err)
+			}
+		}
+	})
+}
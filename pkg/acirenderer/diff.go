@@ -0,0 +1,206 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acirenderer
+
+import (
+	"archive/tar"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+
+	"github.com/appc/spec/schema"
+)
+
+// A FileEntry describes a file of an image as compared by DiffTrees.
+type FileEntry struct {
+	Path     string `json:"path"`
+	Typeflag byte   `json:"typeflag"`
+	Mode     int64  `json:"mode"`
+	Uid      int    `json:"uid"`
+	Gid      int    `json:"gid"`
+	Size     int64  `json:"size"`
+	Linkname string `json:"linkname,omitempty"`
+	// Hash is the sha512 of the contents of regular files.
+	Hash string `json:"hash,omitempty"`
+}
+
+// FileTree maps the cleaned path of every file of an image to its FileEntry.
+// The image manifest is not part of the tree.
+type FileTree map[string]*FileEntry
+
+// ScanTree walks the given tar archive and returns its FileTree. If fileMap
+// is not nil only the files it contains are added to the tree.
+func ScanTree(tr *tar.Reader, fileMap map[string]struct{}) (FileTree, error) {
+	tree := make(FileTree)
+	if err := scanTree(tr, fileMap, tree); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// GetRenderedTree returns the FileTree of a rendered image, reading each
+// image of the RenderedACI once.
+func GetRenderedTree(renderedACI RenderedACI, ap ACIProvider) (FileTree, error) {
+	tree := make(FileTree)
+	for _, ra := range renderedACI {
+		rs, err := ap.ReadStream(ra.Key)
+		if err != nil {
+			return nil, err
+		}
+		err = scanTree(tar.NewReader(rs), ra.FileMap, tree)
+		rs.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tree, nil
+}
+
+func scanTree(tr *tar.Reader, fileMap map[string]struct{}, tree FileTree) error {
+	return Walk(tr, func(hdr *tar.Header) error {
+		name := filepath.Clean(hdr.Name)
+		if name == "manifest" {
+			return nil
+		}
+		if fileMap != nil {
+			if _, ok := fileMap[name]; !ok {
+				return nil
+			}
+			// Every image provides the rootfs directory, keep the
+			// one of the upper image.
+			if _, ok := tree[name]; ok {
+				return nil
+			}
+		}
+		fe := &FileEntry{
+			Path:     name,
+			Typeflag: hdr.Typeflag,
+			Mode:     hdr.Mode,
+			Uid:      hdr.Uid,
+			Gid:      hdr.Gid,
+			Size:     hdr.Size,
+			Linkname: hdr.Linkname,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			fe.Typeflag = tar.TypeReg
+			h := sha512.New()
+			if _, err := io.Copy(h, tr); err != nil {
+				return fmt.Errorf("error reading %q: %v", name, err)
+			}
+			fe.Hash = fmt.Sprintf("sha512-%x", h.Sum(nil))
+		case tar.TypeLink:
+			fe.Linkname = filepath.Clean(hdr.Linkname)
+		}
+		tree[name] = fe
+		return nil
+	})
+}
+
+// FileChange describes how a file differs between two trees. Fields lists
+// the attributes that changed for modified files: one or more of "type",
+// "content", "mode", "owner" and "link".
+type FileChange struct {
+	Path   string            `json:"path"`
+	Type   schema.ChangeType `json:"type"`
+	Fields []string          `json:"fields,omitempty"`
+	Old    *FileEntry        `json:"old,omitempty"`
+	New    *FileEntry        `json:"new,omitempty"`
+}
+
+func (c FileChange) String() string {
+	switch c.Type {
+	case schema.ChangeAdded:
+		return fmt.Sprintf("+ %s", c.Path)
+	case schema.ChangeRemoved:
+		return fmt.Sprintf("- %s", c.Path)
+	default:
+		return fmt.Sprintf("~ %s %v", c.Path, c.Fields)
+	}
+}
+
+// TreeDiff is the list of changes between two trees, sorted by path.
+type TreeDiff []FileChange
+
+// Summary returns the number of added, removed and modified files.
+func (d TreeDiff) Summary() (added, removed, modified int) {
+	for _, c := range d {
+		switch c.Type {
+		case schema.ChangeAdded:
+			added++
+		case schema.ChangeRemoved:
+			removed++
+		default:
+			modified++
+		}
+	}
+	return
+}
+
+// DiffTrees compares two trees. Files are compared by type, content hash,
+// permission bits, owner and link target; modification times are ignored.
+func DiffTrees(a, b FileTree) TreeDiff {
+	paths := make(map[string]struct{}, len(a)+len(b))
+	for p := range a {
+		paths[p] = struct{}{}
+	}
+	for p := range b {
+		paths[p] = struct{}{}
+	}
+	sorted := make([]string, 0, len(paths))
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+
+	var diff TreeDiff
+	for _, p := range sorted {
+		ae, aok := a[p]
+		be, bok := b[p]
+		switch {
+		case aok && !bok:
+			diff = append(diff, FileChange{Path: p, Type: schema.ChangeRemoved, Old: ae})
+		case !aok && bok:
+			diff = append(diff, FileChange{Path: p, Type: schema.ChangeAdded, New: be})
+		default:
+			if fields := diffEntries(ae, be); len(fields) > 0 {
+				diff = append(diff, FileChange{Path: p, Type: schema.ChangeModified, Fields: fields, Old: ae, New: be})
+			}
+		}
+	}
+	return diff
+}
+
+func diffEntries(a, b *FileEntry) []string {
+	var fields []string
+	if a.Typeflag != b.Typeflag {
+		fields = append(fields, "type")
+	}
+	if a.Hash != b.Hash {
+		fields = append(fields, "content")
+	}
+	if a.Mode&07777 != b.Mode&07777 {
+		fields = append(fields, "mode")
+	}
+	if a.Uid != b.Uid || a.Gid != b.Gid {
+		fields = append(fields, "owner")
+	}
+	if a.Linkname != b.Linkname {
+		fields = append(fields, "link")
+	}
+	return fields
+}
@@ -0,0 +1,184 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acirenderer
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+)
+
+func TestDiffTrees(t *testing.T) {
+	dir, err := ioutil.TempDir("", tstprefix)
+	if err != nil {
+		t.Fatalf("error creating tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ds := NewTestStore()
+
+	imj := `
+		{
+		    "acKind": "ImageManifest",
+		    "acVersion": "0.8.11",
+		    "name": "example.com/test01"
+		}
+	`
+	entriesA := []*testTarEntry{
+		{contents: imj, header: &tar.Header{Name: "manifest", Size: int64(len(imj))}},
+		{header: &tar.Header{Name: "rootfs", Typeflag: tar.TypeDir}},
+		{contents: "same", header: &tar.Header{Name: "rootfs/same", Size: 4}},
+		{contents: "old", header: &tar.Header{Name: "rootfs/content", Size: 3}},
+		{contents: "mode", header: &tar.Header{Name: "rootfs/mode", Size: 4}},
+		{header: &tar.Header{Name: "rootfs/link", Typeflag: tar.TypeSymlink, Linkname: "same"}},
+		{contents: "removed", header: &tar.Header{Name: "rootfs/removed", Size: 7}},
+		{header: &tar.Header{Name: "rootfs/type", Typeflag: tar.TypeDir}},
+	}
+	entriesB := []*testTarEntry{
+		{contents: imj, header: &tar.Header{Name: "manifest", Size: int64(len(imj))}},
+		{header: &tar.Header{Name: "rootfs", Typeflag: tar.TypeDir}},
+		{contents: "same", header: &tar.Header{Name: "rootfs/same", Size: 4}},
+		{contents: "new", header: &tar.Header{Name: "rootfs/content", Size: 3}},
+		{contents: "mode", header: &tar.Header{Name: "rootfs/mode", Size: 4, Mode: 0600}},
+		{header: &tar.Header{Name: "rootfs/link", Typeflag: tar.TypeSymlink, Linkname: "content"}},
+		{contents: "added", header: &tar.Header{Name: "rootfs/added", Size: 5}},
+		{header: &tar.Header{Name: "rootfs/type", Typeflag: tar.TypeSymlink, Linkname: "same"}},
+	}
+
+	keyA, err := newTestACI(entriesA, dir, ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keyB, err := newTestACI(entriesB, dir, ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	trees := make([]FileTree, 2)
+	for i, key := range []string{keyA, keyB} {
+		rs, err := ds.ReadStream(key)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		trees[i], err = ScanTree(tar.NewReader(rs), nil)
+		rs.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, ok := trees[0]["manifest"]; ok {
+		t.Errorf("manifest should not be part of the tree")
+	}
+
+	expected := []struct {
+		path   string
+		typ    string
+		fields []string
+	}{
+		{"rootfs/added", "added", nil},
+		{"rootfs/content", "modified", []string{"content"}},
+		{"rootfs/link", "modified", []string{"link"}},
+		{"rootfs/mode", "modified", []string{"mode"}},
+		{"rootfs/removed", "removed", nil},
+		{"rootfs/type", "modified", []string{"type", "mode", "link"}},
+	}
+	diff := DiffTrees(trees[0], trees[1])
+	if len(diff) != len(expected) {
+		t.Fatalf("got %d changes, want %d: %v", len(diff), len(expected), diff)
+	}
+	for i, c := range diff {
+		e := expected[i]
+		if c.Path != e.path || string(c.Type) != e.typ || !reflect.DeepEqual(c.Fields, e.fields) {
+			t.Errorf("#%d: got change %v (%s), want %s %s %v", i, c, c.Type, e.path, e.typ, e.fields)
+		}
+	}
+	if added, removed, modified := diff.Summary(); added != 1 || removed != 1 || modified != 4 {
+		t.Errorf("wrong summary: got %d added, %d removed, %d modified", added, removed, modified)
+	}
+}
+
+func TestGetRenderedTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", tstprefix)
+	if err != nil {
+		t.Fatalf("error creating tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ds := NewTestStore()
+
+	imj := `
+		{
+		    "acKind": "ImageManifest",
+		    "acVersion": "0.8.11",
+		    "name": "example.com/base"
+		}
+	`
+	entries := []*testTarEntry{
+		{contents: imj, header: &tar.Header{Name: "manifest", Size: int64(len(imj))}},
+		{header: &tar.Header{Name: "rootfs", Typeflag: tar.TypeDir}},
+		{contents: "base", header: &tar.Header{Name: "rootfs/a", Size: 4}},
+		{contents: "base", header: &tar.Header{Name: "rootfs/b", Size: 4}},
+	}
+	baseKey, err := newTestACI(entries, dir, ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	imj = `
+		{
+		    "acKind": "ImageManifest",
+		    "acVersion": "0.8.11",
+		    "name": "example.com/app"
+		}
+	`
+	k, _ := types.NewHash(baseKey)
+	imj, err = addDependencies(imj, types.Dependency{ImageName: "example.com/base", ImageID: k})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries = []*testTarEntry{
+		{contents: imj, header: &tar.Header{Name: "manifest", Size: int64(len(imj))}},
+		{header: &tar.Header{Name: "rootfs", Typeflag: tar.TypeDir}},
+		{contents: "app", header: &tar.Header{Name: "rootfs/b", Size: 3}},
+	}
+	appKey, err := newTestACI(entries, dir, ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	h, _ := types.NewHash(appKey)
+	renderedACI, err := GetRenderedACIWithImageID(*h, ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tree, err := GetRenderedTree(renderedACI, ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(tree) != 3 {
+		t.Fatalf("got %d files, want 3: %v", len(tree), tree)
+	}
+	if tree["rootfs/a"] == nil || tree["rootfs/b"] == nil {
+		t.Fatalf("missing files in tree: %v", tree)
+	}
+	if tree["rootfs/a"].Hash == tree["rootfs/b"].Hash {
+		t.Errorf("rootfs/b should be provided by the upper image")
+	}
+	if tree["rootfs/b"].Size != 3 {
+		t.Errorf("rootfs/b: got size %d, want 3", tree["rootfs/b"].Size)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acirenderer
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"github.com/appc/spec/schema"
+)
+
+// WriteFlattenedTar writes the rendered image to w as a single, uncompressed
+// ACI without dependencies. The entries are ordered: first the manifest of
+// the upper image, stripped of its dependencies and path whitelist (already
+// applied to the rendered files), then all the directories sorted by path
+// and finally the other files, from the lowest dependency to the upper image.
+//
+// Hard links whose target is not rendered from the same ACI are written as
+// a regular file with the contents of the target in that ACI, the other
+// hard links to the same target then refer to this file.
+func WriteFlattenedTar(renderedACI RenderedACI, ap ACIProvider, w io.Writer) error {
+	if len(renderedACI) == 0 {
+		return fmt.Errorf("rendered image empty")
+	}
+
+	// The directories are collected first so that they are written before
+	// their contents, whichever ACI provides them.
+	var (
+		manifestHdr *tar.Header
+		manifest    []byte
+		dirs        []*tar.Header
+		// every image provides the rootfs directory, the upper one is
+		// used.
+		seenDirs = make(map[string]struct{})
+	)
+	for _, ra := range renderedACI {
+		rs, err := ap.ReadStream(ra.Key)
+		if err != nil {
+			return err
+		}
+		tr := tar.NewReader(rs)
+		err = Walk(tr, func(hdr *tar.Header) error {
+			name := filepath.Clean(hdr.Name)
+			if _, ok := ra.FileMap[name]; !ok {
+				return nil
+			}
+			switch {
+			case name == "manifest":
+				h := *hdr
+				manifestHdr = &h
+				b, err := ioutil.ReadAll(tr)
+				if err != nil {
+					return fmt.Errorf("error reading manifest: %v", err)
+				}
+				manifest = b
+			case hdr.Typeflag == tar.TypeDir:
+				if _, ok := seenDirs[name]; ok {
+					return nil
+				}
+				seenDirs[name] = struct{}{}
+				h := *hdr
+				h.Name = name
+				dirs = append(dirs, &h)
+			}
+			return nil
+		})
+		rs.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if manifestHdr == nil {
+		return fmt.Errorf("no manifest in rendered image")
+	}
+
+	var im schema.ImageManifest
+	if err := im.UnmarshalJSON(manifest); err != nil {
+		return fmt.Errorf("error parsing manifest: %v", err)
+	}
+	im.Dependencies = nil
+	im.PathWhitelist = nil
+	manifest, err := im.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	manifestHdr.Name = "manifest"
+	manifestHdr.Size = int64(len(manifest))
+
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(manifestHdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return err
+	}
+	sort.Sort(headersByName(dirs))
+	for _, hdr := range dirs {
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+	for i := len(renderedACI) - 1; i >= 0; i-- {
+		if err := flattenACIFiles(renderedACI[i], ap, tw); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func flattenACIFiles(ra *ACIFiles, ap ACIProvider, tw *tar.Writer) error {
+	rs, err := ap.ReadStream(ra.Key)
+	if err != nil {
+		return err
+	}
+	defer rs.Close()
+
+	targets := make(linkTargets)
+	defer targets.close()
+
+	tr := tar.NewReader(rs)
+	return Walk(tr, func(hdr *tar.Header) error {
+		name := filepath.Clean(hdr.Name)
+		if _, ok := ra.LinkTargets[name]; ok {
+			return targets.spool(name, hdr, tr)
+		}
+		if _, ok := ra.FileMap[name]; !ok || name == "manifest" || hdr.Typeflag == tar.TypeDir {
+			return nil
+		}
+
+		h, r, err := targets.resolve(hdr, tr)
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if h.Typeflag == tar.TypeReg || h.Typeflag == tar.TypeRegA {
+			if _, err := io.Copy(tw, r); err != nil {
+				return fmt.Errorf("error writing %q: %v", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+type headersByName []*tar.Header
+
+func (h headersByName) Len() int           { return len(h) }
+func (h headersByName) Less(i, j int) bool { return h[i].Name < h[j].Name }
+func (h headersByName) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
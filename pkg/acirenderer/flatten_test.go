@@ -0,0 +1,130 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acirenderer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+func TestWriteFlattenedTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", tstprefix)
+	if err != nil {
+		t.Fatalf("error creating tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ds := NewTestStore()
+
+	appKey, _ := newLinkTestImages(t, dir, ds)
+	h, _ := types.NewHash(appKey)
+	renderedACI, err := GetRenderedACIWithImageID(*h, ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buf := new(bytes.Buffer)
+	if err := WriteFlattenedTar(renderedACI, ds, buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	type entry struct {
+		name     string
+		typeflag byte
+		linkname string
+		contents string
+	}
+	var entries []entry
+	var im schema.ImageManifest
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	if err := Walk(tr, func(hdr *tar.Header) error {
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if hdr.Name == "manifest" {
+			return im.UnmarshalJSON(b)
+		}
+		entries = append(entries, entry{hdr.Name, hdr.Typeflag, hdr.Linkname, string(b)})
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if im.Name != "example.com/app" || len(im.Dependencies) != 0 || len(im.PathWhitelist) != 0 {
+		t.Errorf("unexpected manifest: %s with %d dependencies and path whitelist %v", im.Name, len(im.Dependencies), im.PathWhitelist)
+	}
+	expected := []entry{
+		{"rootfs", tar.TypeDir, "", ""},
+		{"rootfs/dir", tar.TypeDir, "", ""},
+		// base image, its rootfs/a is shadowed
+		{"rootfs/dir/b", tar.TypeReg, "", "base-b"},
+		{"rootfs/hl", tar.TypeReg, "", "base-a"},
+		// app image
+		{"rootfs/a", tar.TypeReg, "", "app-a"},
+		{"rootfs/c", tar.TypeReg, "", "app-c"},
+		{"rootfs/hl2", tar.TypeLink, "rootfs/c", ""},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected entries:\ngot  %v\nwant %v", entries, expected)
+	}
+
+	// The flattened image renders the same tree as the original one.
+	key, err := ds.WriteACI(writeTempFile(t, dir, buf.Bytes()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h, _ = types.NewHash(key)
+	flattened, err := GetRenderedACIWithImageID(*h, ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(flattened) != 1 {
+		t.Fatalf("flattened image has %d layers, want 1", len(flattened))
+	}
+	originalTree, err := GetRenderedTree(renderedACI, ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	flattenedTree, err := GetRenderedTree(flattened, ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, c := range DiffTrees(originalTree, flattenedTree) {
+		// rootfs/hl was a hard link to a shadowed file
+		if c.Path == "rootfs/hl" && reflect.DeepEqual(c.Fields, []string{"type", "content", "link"}) {
+			continue
+		}
+		t.Errorf("unexpected change in the flattened image: %v", c)
+	}
+}
+
+func writeTempFile(t *testing.T, dir string, b []byte) string {
+	f, err := ioutil.TempFile(dir, "flattened")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return filepath.Clean(f.Name())
+}
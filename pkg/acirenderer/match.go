@@ -0,0 +1,218 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acirenderer
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+const (
+	labelVersion = "version"
+	labelOS      = "os"
+	labelArch    = "arch"
+
+	// LatestVersion is the version label value matching any version.
+	LatestVersion = "latest"
+)
+
+// A Candidate is an image which may satisfy a dependency.
+type Candidate struct {
+	// ImageID is the image ID of the candidate. A candidate with an
+	// empty image ID never matches a dependency with an image ID.
+	ImageID  types.Hash
+	Manifest *schema.ImageManifest
+}
+
+// A DependencyMatcher chooses the image satisfying a dependency among
+// candidate images, following the Dependency Matching section of the spec:
+//
+//   - the name of the image must be the name of the dependency;
+//   - every label of the dependency must have the same value in the image,
+//     except for a "version" label with the "latest" value, which matches
+//     any version, or with a version constraint (see
+//     types.VersionConstraint), which matches the semantic versions
+//     meeting it, and for the "os" and "arch" labels, which also match
+//     images without them (as they are OS- or architecture-independent);
+//   - if the dependency has an image ID, it must be the one of the image.
+//
+// If several images match, the one with the highest version is chosen;
+// versions which are not semantic versions are lower than semantic ones and
+// compared as strings. For the same version, images with the os and arch
+// labels are preferred to independent ones, and the smallest image ID is
+// chosen last so that the result does not depend on the candidates order.
+type DependencyMatcher struct {
+	// DefaultLabels are used for the labels a dependency does not have,
+	// usually the os and arch of the host. A default label follows the
+	// same rules as a label of the dependency.
+	DefaultLabels types.Labels
+}
+
+// NewDependencyMatcher returns a DependencyMatcher using the os and arch of
+// the host as default labels.
+func NewDependencyMatcher() (*DependencyMatcher, error) {
+	os, arch, err := types.ToAppcOSArch(runtime.GOOS, runtime.GOARCH, "")
+	if err != nil {
+		return nil, err
+	}
+	return &DependencyMatcher{
+		DefaultLabels: types.Labels{
+			{Name: labelOS, Value: os},
+			{Name: labelArch, Value: arch},
+		},
+	}, nil
+}
+
+// Match returns the candidate satisfying the dependency. An error is
+// returned if none does.
+func (m *DependencyMatcher) Match(dep types.Dependency, candidates []Candidate) (*Candidate, error) {
+	labels := m.labels(dep)
+	var vc *types.VersionConstraint
+	if v, ok := labels.Get(labelVersion); ok && types.IsVersionConstraint(v) {
+		var err error
+		if vc, err = types.NewVersionConstraint(v); err != nil {
+			return nil, err
+		}
+	}
+	var best *Candidate
+	for i := range candidates {
+		c := &candidates[i]
+		if !m.matches(dep, labels, vc, c) {
+			continue
+		}
+		if best == nil || better(c, best) {
+			best = c
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no image matches dependency %s", describeDependency(dep))
+	}
+	return best, nil
+}
+
+// labels returns the labels of dep with the default labels it does not
+// have.
+func (m *DependencyMatcher) labels(dep types.Dependency) types.Labels {
+	labels := append(types.Labels{}, dep.Labels...)
+	for _, l := range m.DefaultLabels {
+		if _, ok := dep.Labels.Get(l.Name.String()); !ok {
+			labels = append(labels, l)
+		}
+	}
+	return labels
+}
+
+func (m *DependencyMatcher) matches(dep types.Dependency, labels types.Labels, vc *types.VersionConstraint, c *Candidate) bool {
+	if c.Manifest == nil || !c.Manifest.Name.Equals(dep.ImageName) {
+		return false
+	}
+	if dep.ImageID != nil && !dep.ImageID.Empty() {
+		if c.ImageID.Empty() || c.ImageID.String() != dep.ImageID.String() {
+			return false
+		}
+	}
+	for _, l := range labels {
+		v, ok := c.Manifest.Labels.Get(l.Name.String())
+		switch l.Name {
+		case labelVersion:
+			if l.Value == LatestVersion {
+				continue
+			}
+			if vc != nil {
+				if !ok {
+					return false
+				}
+				sv, err := types.NewSemVer(v)
+				if err != nil || !vc.Check(*sv) {
+					return false
+				}
+				continue
+			}
+		case labelOS, labelArch:
+			if !ok {
+				continue
+			}
+		}
+		if !ok || v != l.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// better returns whether a is preferred to b.
+func better(a, b *Candidate) bool {
+	va, _ := a.Manifest.Labels.Get(labelVersion)
+	vb, _ := b.Manifest.Labels.Get(labelVersion)
+	if c := compareVersions(va, vb); c != 0 {
+		return c > 0
+	}
+	if sa, sb := osArchSpecificity(a.Manifest), osArchSpecificity(b.Manifest); sa != sb {
+		return sa > sb
+	}
+	return a.ImageID.String() < b.ImageID.String()
+}
+
+// compareVersions returns -1, 0 or 1 if the version a is lower, equal or
+// greater than b. Semantic versions are greater than other versions, which
+// are greater than no version.
+func compareVersions(a, b string) int {
+	sa, erra := types.NewSemVer(a)
+	sb, errb := types.NewSemVer(b)
+	switch {
+	case erra == nil && errb == nil:
+		switch {
+		case sa.LessThanExact(*sb):
+			return -1
+		case sb.LessThanExact(*sa):
+			return 1
+		}
+		return 0
+	case erra == nil:
+		return 1
+	case errb == nil:
+		return -1
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func osArchSpecificity(im *schema.ImageManifest) int {
+	n := 0
+	if _, ok := im.Labels.Get(labelOS); ok {
+		n++
+	}
+	if _, ok := im.Labels.Get(labelArch); ok {
+		n++
+	}
+	return n
+}
+
+func describeDependency(dep types.Dependency) string {
+	s := dep.ImageName.String()
+	for _, l := range dep.Labels {
+		s += fmt.Sprintf(",%s=%s", l.Name, l.Value)
+	}
+	if dep.ImageID != nil && !dep.ImageID.Empty() {
+		s += fmt.Sprintf(" (%s)", types.ShortHash(dep.ImageID.String()))
+	}
+	return s
+}
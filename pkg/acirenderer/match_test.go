@@ -0,0 +1,243 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acirenderer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+func newCandidate(id int, name string, labels ...string) Candidate {
+	im := schema.BlankImageManifest()
+	im.Name = types.ACIdentifier(name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		im.Labels = append(im.Labels, types.Label{Name: types.ACIdentifier(labels[i]), Value: labels[i+1]})
+	}
+	h, err := types.NewHash(fmt.Sprintf("sha512-%0128x", id))
+	if err != nil {
+		panic(err)
+	}
+	return Candidate{ImageID: *h, Manifest: im}
+}
+
+func newDependency(name string, labels ...string) types.Dependency {
+	dep := types.Dependency{ImageName: types.ACIdentifier(name)}
+	for i := 0; i+1 < len(labels); i += 2 {
+		dep.Labels = append(dep.Labels, types.Label{Name: types.ACIdentifier(labels[i]), Value: labels[i+1]})
+	}
+	return dep
+}
+
+func TestDependencyMatcher(t *testing.T) {
+	linuxAmd64 := types.Labels{
+		{Name: "os", Value: "linux"},
+		{Name: "arch", Value: "amd64"},
+	}
+	pinned := newDependency("example.com/a")
+	h, _ := types.NewHash(fmt.Sprintf("sha512-%0128x", 2))
+	pinned.ImageID = h
+
+	tests := []struct {
+		defaults   types.Labels
+		dep        types.Dependency
+		candidates []Candidate
+		// id of the expected candidate, 0 for no match
+		expected int
+	}{
+		// name mismatch
+		{
+			nil,
+			newDependency("example.com/a"),
+			[]Candidate{newCandidate(1, "example.com/b")},
+			0,
+		},
+		// no version picks the highest semver
+		{
+			nil,
+			newDependency("example.com/a"),
+			[]Candidate{
+				newCandidate(1, "example.com/a", "version", "1.10.0"),
+				newCandidate(2, "example.com/a", "version", "1.9.0"),
+				newCandidate(3, "example.com/a", "version", "notsemver"),
+				newCandidate(4, "example.com/a"),
+			},
+			1,
+		},
+		// exact version
+		{
+			nil,
+			newDependency("example.com/a", "version", "1.9.0"),
+			[]Candidate{
+				newCandidate(1, "example.com/a", "version", "1.10.0"),
+				newCandidate(2, "example.com/a", "version", "1.9.0"),
+			},
+			2,
+		},
+		// latest matches any version
+		{
+			nil,
+			newDependency("example.com/a", "version", "latest"),
+			[]Candidate{
+				newCandidate(1, "example.com/a", "version", "1.0.0"),
+				newCandidate(2, "example.com/a", "version", "2.0.0"),
+			},
+			2,
+		},
+		// a version constraint picks the highest satisfying semver
+		{
+			nil,
+			newDependency("example.com/a", "version", ">=1.2.0, <2.0.0"),
+			[]Candidate{
+				newCandidate(1, "example.com/a", "version", "1.1.0"),
+				newCandidate(2, "example.com/a", "version", "1.4.2"),
+				newCandidate(3, "example.com/a", "version", "1.10.1"),
+				newCandidate(4, "example.com/a", "version", "2.0.0"),
+				newCandidate(5, "example.com/a", "version", "notsemver"),
+				newCandidate(6, "example.com/a"),
+			},
+			3,
+		},
+		{
+			nil,
+			newDependency("example.com/a", "version", "~1.4"),
+			[]Candidate{
+				newCandidate(1, "example.com/a", "version", "1.4.0"),
+				newCandidate(2, "example.com/a", "version", "1.4.3"),
+				newCandidate(3, "example.com/a", "version", "1.5.0"),
+			},
+			2,
+		},
+		{
+			nil,
+			newDependency("example.com/a", "version", "~1.4"),
+			[]Candidate{newCandidate(1, "example.com/a", "version", "1.3.0")},
+			0,
+		},
+		// a version with operator characters not at its start is plain
+		{
+			nil,
+			newDependency("example.com/a", "version", "2.0~rc1"),
+			[]Candidate{
+				newCandidate(1, "example.com/a", "version", "2.0.0"),
+				newCandidate(2, "example.com/a", "version", "2.0~rc1"),
+			},
+			2,
+		},
+		// bad version constraint
+		{
+			nil,
+			newDependency("example.com/a", "version", ">=one"),
+			[]Candidate{newCandidate(1, "example.com/a", "version", "1.0.0")},
+			0,
+		},
+		// other labels must match exactly
+		{
+			nil,
+			newDependency("example.com/a", "channel", "beta"),
+			[]Candidate{
+				newCandidate(1, "example.com/a", "channel", "stable"),
+				newCandidate(2, "example.com/a"),
+			},
+			0,
+		},
+		// os and arch independent images match
+		{
+			nil,
+			newDependency("example.com/a", "os", "linux", "arch", "amd64"),
+			[]Candidate{
+				newCandidate(1, "example.com/a", "os", "freebsd"),
+				newCandidate(2, "example.com/a"),
+			},
+			2,
+		},
+		// specific images are preferred to independent ones
+		{
+			nil,
+			newDependency("example.com/a", "os", "linux"),
+			[]Candidate{
+				newCandidate(1, "example.com/a"),
+				newCandidate(2, "example.com/a", "os", "linux"),
+			},
+			2,
+		},
+		// defaults apply to labels missing from the dependency
+		{
+			linuxAmd64,
+			newDependency("example.com/a"),
+			[]Candidate{
+				newCandidate(1, "example.com/a", "os", "linux", "arch", "arm64"),
+				newCandidate(2, "example.com/a", "os", "linux", "arch", "amd64"),
+			},
+			2,
+		},
+		// the labels of the dependency override the defaults
+		{
+			linuxAmd64,
+			newDependency("example.com/a", "arch", "arm64"),
+			[]Candidate{
+				newCandidate(1, "example.com/a", "os", "linux", "arch", "arm64"),
+				newCandidate(2, "example.com/a", "os", "linux", "arch", "amd64"),
+			},
+			1,
+		},
+		// the image ID must match
+		{
+			nil,
+			pinned,
+			[]Candidate{
+				newCandidate(1, "example.com/a", "version", "2.0.0"),
+				newCandidate(2, "example.com/a", "version", "1.0.0"),
+			},
+			2,
+		},
+		{
+			nil,
+			pinned,
+			[]Candidate{newCandidate(1, "example.com/a")},
+			0,
+		},
+		// ties are broken by image ID
+		{
+			nil,
+			newDependency("example.com/a"),
+			[]Candidate{
+				newCandidate(3, "example.com/a", "version", "1.0.0"),
+				newCandidate(1, "example.com/a", "version", "1.0.0"),
+			},
+			1,
+		},
+	}
+
+	for i, tt := range tests {
+		m := &DependencyMatcher{DefaultLabels: tt.defaults}
+		c, err := m.Match(tt.dep, tt.candidates)
+		if tt.expected == 0 {
+			if err == nil {
+				t.Errorf("#%d: expected no match, got %s", i, c.ImageID)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if want := fmt.Sprintf("sha512-%0128x", tt.expected); c.ImageID.String() != want {
+			t.Errorf("#%d: got %s, want %s", i, c.ImageID, want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acirenderer
+
+import (
+	"github.com/appc/spec/schema/types"
+)
+
+// A DropReason tells why a file of an image is not rendered.
+type DropReason string
+
+const (
+	// DropPathWhitelist is used for files excluded by the path whitelist
+	// of their image or of an upper image.
+	DropPathWhitelist DropReason = "pathWhitelist"
+	// DropParentNotDir is used for files whose parent directory is
+	// provided by an upper image as something else than a directory.
+	DropParentNotDir DropReason = "parentNotDir"
+	// DropAlreadyProvided is used for files shadowed by the same file of
+	// an upper image.
+	DropAlreadyProvided DropReason = "alreadyProvided"
+)
+
+// A DroppedFile is a copy of a file, in the given image, which is not
+// rendered.
+type DroppedFile struct {
+	Key    string             `json:"key"`
+	Name   types.ACIdentifier `json:"name"`
+	Reason DropReason         `json:"reason"`
+}
+
+// FileProvenance describes which image provides a file of the rendered image
+// and which copies of the file are dropped, in the order of the images.
+type FileProvenance struct {
+	// Key and Name are the key and the name of the providing image. They
+	// are empty if every copy of the file is dropped.
+	Key     string             `json:"key,omitempty"`
+	Name    types.ACIdentifier `json:"name,omitempty"`
+	Dropped []DroppedFile      `json:"dropped,omitempty"`
+}
+
+// Provenance maps the cleaned path of every file found in the images of a
+// rendered image to its FileProvenance.
+type Provenance map[string]*FileProvenance
+
+func (p Provenance) get(name string) *FileProvenance {
+	fp, ok := p[name]
+	if !ok {
+		fp = &FileProvenance{}
+		p[name] = fp
+	}
+	return fp
+}
+
+// provide records that img provides the file. It does nothing on a nil
+// Provenance.
+func (p Provenance) provide(name string, img Image) {
+	if p == nil {
+		return
+	}
+	fp := p.get(name)
+	fp.Key = img.Key
+	fp.Name = img.Im.Name
+}
+
+// drop records that the file of img is not rendered. It does nothing on a
+// nil Provenance.
+func (p Provenance) drop(name string, img Image, reason DropReason) {
+	if p == nil {
+		return
+	}
+	fp := p.get(name)
+	fp.Dropped = append(fp.Dropped, DroppedFile{Key: img.Key, Name: img.Im.Name, Reason: reason})
+}
@@ -0,0 +1,123 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acirenderer
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+)
+
+func TestProvenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", tstprefix)
+	if err != nil {
+		t.Fatalf("error creating tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ds := NewTestStore()
+
+	imj := `
+		{
+		    "acKind": "ImageManifest",
+		    "acVersion": "0.8.11",
+		    "name": "example.com/base"
+		}
+	`
+	entries := []*testTarEntry{
+		{contents: imj, header: &tar.Header{Name: "manifest", Size: int64(len(imj))}},
+		{header: &tar.Header{Name: "rootfs", Typeflag: tar.TypeDir}},
+		{header: &tar.Header{Name: "rootfs/d", Typeflag: tar.TypeDir}},
+		{contents: "base", header: &tar.Header{Name: "rootfs/d/f", Size: 4}},
+		{contents: "base", header: &tar.Header{Name: "rootfs/x", Size: 4}},
+		{contents: "base", header: &tar.Header{Name: "rootfs/y", Size: 4}},
+		{contents: "base", header: &tar.Header{Name: "rootfs/z", Size: 4}},
+	}
+	baseKey, err := newTestACI(entries, dir, ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	imj = `
+		{
+		    "acKind": "ImageManifest",
+		    "acVersion": "0.8.11",
+		    "name": "example.com/app",
+		    "pathWhitelist": ["/d", "/d/f", "/x", "/z"]
+		}
+	`
+	k, _ := types.NewHash(baseKey)
+	imj, err = addDependencies(imj, types.Dependency{ImageName: "example.com/base", ImageID: k})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries = []*testTarEntry{
+		{contents: imj, header: &tar.Header{Name: "manifest", Size: int64(len(imj))}},
+		{header: &tar.Header{Name: "rootfs", Typeflag: tar.TypeDir}},
+		{contents: "app", header: &tar.Header{Name: "rootfs/d", Size: 3}},
+		{contents: "app", header: &tar.Header{Name: "rootfs/x", Size: 3}},
+		{contents: "app", header: &tar.Header{Name: "rootfs/w", Size: 3}},
+	}
+	appKey, err := newTestACI(entries, dir, ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	h, _ := types.NewHash(appKey)
+	imgs, err := CreateDepListFromImageID(*h, ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	renderedACI, prov, err := GetRenderedACIFromListWithProvenance(imgs, ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	app := FileProvenance{Key: appKey, Name: "example.com/app"}
+	base := FileProvenance{Key: baseKey, Name: "example.com/base"}
+	dropped := func(fp FileProvenance, key string, name types.ACIdentifier, reason DropReason) *FileProvenance {
+		fp.Dropped = append(fp.Dropped, DroppedFile{key, name, reason})
+		return &fp
+	}
+	expected := Provenance{
+		"manifest":   &app,
+		"rootfs":     dropped(app, baseKey, "example.com/base", DropAlreadyProvided),
+		"rootfs/d":   dropped(app, baseKey, "example.com/base", DropAlreadyProvided),
+		"rootfs/d/f": dropped(FileProvenance{}, baseKey, "example.com/base", DropParentNotDir),
+		"rootfs/w":   dropped(FileProvenance{}, appKey, "example.com/app", DropPathWhitelist),
+		"rootfs/x":   dropped(app, baseKey, "example.com/base", DropAlreadyProvided),
+		"rootfs/y":   dropped(FileProvenance{}, baseKey, "example.com/base", DropPathWhitelist),
+		"rootfs/z":   &base,
+	}
+	for name, e := range expected {
+		if !reflect.DeepEqual(prov[name], e) {
+			t.Errorf("%s: got provenance %+v, want %+v", name, prov[name], e)
+		}
+	}
+	if len(prov) != len(expected) {
+		t.Errorf("got %d files, want %d", len(prov), len(expected))
+	}
+
+	// The provenance does not change the rendered image.
+	withoutProvenance, err := GetRenderedACIFromList(imgs, ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(renderedACI, withoutProvenance) {
+		t.Errorf("rendered images differ")
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acirenderer
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/appc/spec/aci"
+)
+
+// RenderToDir writes the rendered image into dir, using the ACI layout: the
+// manifest of the upper image and the merged rootfs directory. Each ACI is
+// read once, from the lowest dependency to the upper image, and only the
+// files of its FileMap are extracted.
+//
+// Hard links are kept: a hard link whose target is not extracted from the
+// same ACI (because it is shadowed by an upper image or excluded by a path
+// whitelist) gets the contents of the target in that ACI, as listed in
+// LinkTargets, the other hard links to the same target then refer to it.
+// The contents of those targets are spooled in temporary files meanwhile.
+// Owners are only restored when running as root.
+func RenderToDir(renderedACI RenderedACI, ap ACIProvider, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	x := aci.NewExtractor(dir)
+	for i := len(renderedACI) - 1; i >= 0; i-- {
+		if err := renderACIFiles(renderedACI[i], ap, x); err != nil {
+			return err
+		}
+	}
+	return x.Finish()
+}
+
+func renderACIFiles(ra *ACIFiles, ap ACIProvider, x *aci.Extractor) error {
+	rs, err := ap.ReadStream(ra.Key)
+	if err != nil {
+		return err
+	}
+	defer rs.Close()
+
+	targets := make(linkTargets)
+	defer targets.close()
+
+	tr := tar.NewReader(rs)
+	return Walk(tr, func(hdr *tar.Header) error {
+		name := filepath.Clean(hdr.Name)
+		if _, ok := ra.LinkTargets[name]; ok {
+			return targets.spool(name, hdr, tr)
+		}
+		if _, ok := ra.FileMap[name]; !ok {
+			return nil
+		}
+		h, r, err := targets.resolve(hdr, tr)
+		if err != nil {
+			return err
+		}
+		if err := x.ExtractEntry(h, r); err != nil {
+			return fmt.Errorf("error rendering %s: %v", ra.Key, err)
+		}
+		return nil
+	})
+}
+
+// linkTarget is the spooled contents of a hard link target not rendered
+// from its ACI.
+type linkTarget struct {
+	hdr  *tar.Header
+	file *os.File
+	// written is the name of the file written for the first hard link to
+	// the target, if any.
+	written string
+}
+
+// linkTargets are the spooled link targets of an ACI, keyed by name.
+type linkTargets map[string]*linkTarget
+
+// spool copies the contents of the link target to a temporary file.
+func (ts linkTargets) spool(name string, hdr *tar.Header, r io.Reader) error {
+	f, err := ioutil.TempFile("", "acirenderer-")
+	if err != nil {
+		return err
+	}
+	h := *hdr
+	ts[name] = &linkTarget{hdr: &h, file: f}
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("error reading %q: %v", name, err)
+	}
+	return nil
+}
+
+// resolve returns the entry to render for hdr, with a clean name, and the
+// reader of its contents. The first hard link to a spooled target is
+// rendered as the target, with its spooled contents, and the next ones as
+// hard links to the first.
+func (ts linkTargets) resolve(hdr *tar.Header, r io.Reader) (*tar.Header, io.Reader, error) {
+	h := *hdr
+	h.Name = filepath.Clean(hdr.Name)
+	if hdr.Typeflag != tar.TypeLink {
+		return &h, r, nil
+	}
+	h.Linkname = filepath.Clean(hdr.Linkname)
+	t, ok := ts[h.Linkname]
+	if !ok {
+		return &h, r, nil
+	}
+	if t.written != "" {
+		h.Linkname = t.written
+		return &h, r, nil
+	}
+	if _, err := t.file.Seek(0, 0); err != nil {
+		return nil, nil, err
+	}
+	name := h.Name
+	h = *t.hdr
+	h.Name = name
+	t.written = name
+	return &h, t.file, nil
+}
+
+// close removes the spooled files.
+func (ts linkTargets) close() {
+	for _, t := range ts {
+		t.file.Close()
+		os.Remove(t.file.Name())
+	}
+}
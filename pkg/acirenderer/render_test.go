@@ -0,0 +1,148 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acirenderer
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+)
+
+func TestRenderToDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", tstprefix)
+	if err != nil {
+		t.Fatalf("error creating tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ds := NewTestStore()
+
+	appKey, imj := newLinkTestImages(t, dir, ds)
+
+	h, _ := types.NewHash(appKey)
+	renderedACI, err := GetRenderedACIWithImageID(*h, ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rootDir := filepath.Join(dir, "rendered")
+	if err := RenderToDir(renderedACI, ds, rootDir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]string{
+		"manifest":     imj,
+		"rootfs/a":     "app-a",
+		"rootfs/c":     "app-c",
+		"rootfs/dir/b": "base-b",
+		"rootfs/hl":    "base-a",
+		"rootfs/hl2":   "app-c",
+	}
+	for name, contents := range expected {
+		b, err := ioutil.ReadFile(filepath.Join(rootDir, name))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+			continue
+		}
+		if string(b) != contents {
+			t.Errorf("%s: got contents %q, want %q", name, b, contents)
+		}
+	}
+
+	fis, err := ioutil.ReadDir(rootDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(fis) != 2 {
+		t.Errorf("got %d files in the rendered directory, want the manifest and rootfs", len(fis))
+	}
+	if _, err := os.Lstat(filepath.Join(rootDir, "rootfs/excluded")); !os.IsNotExist(err) {
+		t.Errorf("rootfs/excluded should not be rendered")
+	}
+	fi, err := os.Stat(filepath.Join(rootDir, "rootfs/dir"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fi.Mode().Perm() != 0700 {
+		t.Errorf("rootfs/dir: got mode %v, want %v", fi.Mode().Perm(), os.FileMode(0700))
+	}
+
+	fi1, err := os.Stat(filepath.Join(rootDir, "rootfs/c"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fi2, err := os.Stat(filepath.Join(rootDir, "rootfs/hl2"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !os.SameFile(fi1, fi2) {
+		t.Errorf("rootfs/hl2 is not a hard link to rootfs/c")
+	}
+}
+
+// newLinkTestImages creates an app image depending on a base image, both
+// having hard links, and returns the key and the manifest of the app image.
+// Its path whitelist excludes rootfs/excluded of the base image, its
+// rootfs/a shadows the target of the rootfs/hl hard link of the base image.
+func newLinkTestImages(t *testing.T, dir string, ds *TestStore) (string, string) {
+	imj := `
+		{
+		    "acKind": "ImageManifest",
+		    "acVersion": "0.8.11",
+		    "name": "example.com/base"
+		}
+	`
+	entries := []*testTarEntry{
+		{contents: imj, header: &tar.Header{Name: "manifest", Size: int64(len(imj))}},
+		{header: &tar.Header{Name: "rootfs", Typeflag: tar.TypeDir}},
+		{header: &tar.Header{Name: "rootfs/dir", Typeflag: tar.TypeDir, Mode: 0700}},
+		{contents: "base-a", header: &tar.Header{Name: "rootfs/a", Size: 6}},
+		{contents: "base-b", header: &tar.Header{Name: "rootfs/dir/b", Size: 6}},
+		{contents: "excluded", header: &tar.Header{Name: "rootfs/excluded", Size: 8}},
+		{header: &tar.Header{Name: "rootfs/hl", Typeflag: tar.TypeLink, Linkname: "rootfs/a"}},
+	}
+	baseKey, err := newTestACI(entries, dir, ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	imj = `
+		{
+		    "acKind": "ImageManifest",
+		    "acVersion": "0.8.11",
+		    "name": "example.com/app",
+		    "pathWhitelist": ["/a", "/c", "/dir", "/dir/b", "/hl", "/hl2"]
+		}
+	`
+	k, _ := types.NewHash(baseKey)
+	imj, err = addDependencies(imj, types.Dependency{ImageName: "example.com/base", ImageID: k})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries = []*testTarEntry{
+		{contents: imj, header: &tar.Header{Name: "manifest", Size: int64(len(imj))}},
+		{header: &tar.Header{Name: "rootfs", Typeflag: tar.TypeDir}},
+		{contents: "app-a", header: &tar.Header{Name: "rootfs/a", Size: 5}},
+		{contents: "app-c", header: &tar.Header{Name: "rootfs/c", Size: 5}},
+		{header: &tar.Header{Name: "rootfs/hl2", Typeflag: tar.TypeLink, Linkname: "rootfs/c"}},
+	}
+	appKey, err := newTestACI(entries, dir, ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return appKey, imj
+}
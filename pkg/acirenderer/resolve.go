@@ -16,32 +16,82 @@ package acirenderer
 
 import (
 	"container/list"
+	"fmt"
+	"strings"
 
 	"github.com/appc/spec/schema/types"
 )
 
+// DefaultMaxDepth is the maximum level of a dependency in the dependency tree
+// used when none is given in the ResolveOptions.
+const DefaultMaxDepth = 256
+
+// ResolveOptions tunes the creation of the flat dependency tree.
+type ResolveOptions struct {
+	// Dedup removes the repeated images (for example, the common
+	// dependency of two dependencies), keeping only the first occurrence
+	// of each key and its dependencies.
+	Dedup bool
+	// MaxDepth is the maximum level of a dependency. If zero,
+	// DefaultMaxDepth is used.
+	MaxDepth uint16
+}
+
+// ErrDependencyCycle is returned when an image depends, directly or
+// transitively, on itself.
+type ErrDependencyCycle struct {
+	// Images are the images of the cycle, the first one being the same as
+	// the last one.
+	Images []Image
+}
+
+func (e ErrDependencyCycle) Error() string {
+	names := make([]string, 0, len(e.Images))
+	for _, img := range e.Images {
+		names = append(names, img.Im.Name.String())
+	}
+	return fmt.Sprintf("dependency cycle: %s", strings.Join(names, " -> "))
+}
+
 // CreateDepListFromImageID returns the flat dependency tree of the image with
 // the provided imageID
 func CreateDepListFromImageID(imageID types.Hash, ap ACIRegistry) (Images, error) {
+	return CreateDepListFromImageIDWithOptions(imageID, ap, ResolveOptions{})
+}
+
+// CreateDepListFromImageIDWithOptions is like CreateDepListFromImageID, using
+// the given ResolveOptions.
+func CreateDepListFromImageIDWithOptions(imageID types.Hash, ap ACIRegistry, opts ResolveOptions) (Images, error) {
 	key, err := ap.ResolveKey(imageID.String())
 	if err != nil {
 		return nil, err
 	}
-	return createDepList(key, ap)
+	return createDepList(key, ap, opts)
 }
 
 // CreateDepListFromNameLabels returns the flat dependency tree of the image
 // with the provided app name and optional labels.
 func CreateDepListFromNameLabels(name types.ACIdentifier, labels types.Labels, ap ACIRegistry) (Images, error) {
+	return CreateDepListFromNameLabelsWithOptions(name, labels, ap, ResolveOptions{})
+}
+
+// CreateDepListFromNameLabelsWithOptions is like CreateDepListFromNameLabels,
+// using the given ResolveOptions.
+func CreateDepListFromNameLabelsWithOptions(name types.ACIdentifier, labels types.Labels, ap ACIRegistry, opts ResolveOptions) (Images, error) {
 	key, err := ap.GetACI(name, labels)
 	if err != nil {
 		return nil, err
 	}
-	return createDepList(key, ap)
+	return createDepList(key, ap, opts)
 }
 
 // createDepList returns the flat dependency tree as a list of Image type
-func createDepList(key string, ap ACIRegistry) (Images, error) {
+func createDepList(key string, ap ACIRegistry, opts ResolveOptions) (Images, error) {
+	maxDepth := opts.MaxDepth
+	if maxDepth == 0 {
+		maxDepth = DefaultMaxDepth
+	}
+
 	imgsl := list.New()
 	im, err := ap.GetImageManifest(key)
 	if err != nil {
@@ -50,12 +100,34 @@ func createDepList(key string, ap ACIRegistry) (Images, error) {
 
 	img := Image{Im: im, Key: key, Level: 0}
 	imgsl.PushFront(img)
+	// parents maps each element of the list to the element of the image
+	// depending on it, to detect cycles.
+	parents := make(map[*list.Element]*list.Element)
+
+	// seen are the keys of the images already walked with Dedup.
+	seen := make(map[string]struct{})
 
 	// Create a flat dependency tree. Use a LinkedList to be able to
 	// insert elements in the list while working on it.
-	for el := imgsl.Front(); el != nil; el = el.Next() {
+	var next *list.Element
+	for el := imgsl.Front(); el != nil; el = next {
+		next = el.Next()
 		img := el.Value.(Image)
+		if opts.Dedup {
+			// The list is walked in order, so the repeated image and
+			// its whole subtree can be removed before walking them:
+			// their first occurrence is kept.
+			if _, ok := seen[img.Key]; ok {
+				imgsl.Remove(el)
+				delete(parents, el)
+				continue
+			}
+			seen[img.Key] = struct{}{}
+		}
 		dependencies := img.Im.Dependencies
+		if len(dependencies) > 0 && img.Level >= maxDepth {
+			return nil, fmt.Errorf("dependency tree of %s exceeds the maximum depth of %d", imgsl.Front().Value.(Image).Im.Name, maxDepth)
+		}
 		for _, d := range dependencies {
 			var depimg Image
 			var depKey string
@@ -75,9 +147,13 @@ func createDepList(key string, ap ACIRegistry) (Images, error) {
 			if err != nil {
 				return nil, err
 			}
-			depimg = Image{Im: im, Key: depKey, Level: img.Level + 1}
-			imgsl.InsertAfter(depimg, el)
+			depimg = Image{Im: im, Key: depKey, Level: img.Level + 1, Size: uint64(d.Size)}
+			if err := checkCycle(depimg, el, parents); err != nil {
+				return nil, err
+			}
+			parents[imgsl.InsertAfter(depimg, el)] = el
 		}
+		next = el.Next()
 	}
 
 	imgs := Images{}
@@ -86,3 +162,22 @@ func createDepList(key string, ap ACIRegistry) (Images, error) {
 	}
 	return imgs, nil
 }
+
+// checkCycle returns an ErrDependencyCycle if img is already one of the
+// images from the upper image to the one at el.
+func checkCycle(img Image, el *list.Element, parents map[*list.Element]*list.Element) error {
+	cycle := []Image{img}
+	for ; el != nil; el = parents[el] {
+		parent := el.Value.(Image)
+		cycle = append(cycle, parent)
+		if parent.Key != img.Key {
+			continue
+		}
+		// reverse the cycle to list the images from the depending one
+		for i, j := 0, len(cycle)-1; i < j; i, j = i+1, j-1 {
+			cycle[i], cycle[j] = cycle[j], cycle[i]
+		}
+		return ErrDependencyCycle{Images: cycle}
+	}
+	return nil
+}
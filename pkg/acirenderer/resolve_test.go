@@ -0,0 +1,244 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acirenderer
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+)
+
+// newManifestOnlyACI adds to ds an image with the given name and
+// dependencies, referenced by name, and returns its key.
+func newManifestOnlyACI(name string, deps []string, dir string, ds *TestStore) (string, error) {
+	imj := fmt.Sprintf(`{"acKind": "ImageManifest", "acVersion": "0.8.11", "name": %q}`, name)
+	for _, d := range deps {
+		var err error
+		imj, err = addDependencies(imj, types.Dependency{ImageName: types.ACIdentifier(d)})
+		if err != nil {
+			return "", err
+		}
+	}
+	entries := []*testTarEntry{
+		{contents: imj, header: &tar.Header{Name: "manifest", Size: int64(len(imj))}},
+	}
+	return newTestACI(entries, dir, ds)
+}
+
+func TestCreateDepList(t *testing.T) {
+	tests := []struct {
+		images map[string][]string
+		opts   ResolveOptions
+
+		expected []string
+		err      string
+	}{
+		// Dependencies in order
+		{
+			map[string][]string{"a": {"b", "c"}, "b": nil, "c": {"d"}, "d": nil},
+			ResolveOptions{},
+			[]string{"a", "c", "d", "b"},
+			"",
+		},
+		// Diamond, rendered twice by default
+		{
+			map[string][]string{"a": {"b", "c"}, "b": {"d"}, "c": {"d"}, "d": {"e"}, "e": nil},
+			ResolveOptions{},
+			[]string{"a", "c", "d", "e", "b", "d", "e"},
+			"",
+		},
+		// Diamond, deduplicated
+		{
+			map[string][]string{"a": {"b", "c"}, "b": {"d"}, "c": {"d"}, "d": {"e"}, "e": nil},
+			ResolveOptions{Dedup: true},
+			[]string{"a", "c", "d", "e", "b"},
+			"",
+		},
+		// The first occurrence is kept
+		{
+			map[string][]string{"a": {"d", "c", "b"}, "b": {"d"}, "c": nil, "d": nil},
+			ResolveOptions{Dedup: true},
+			[]string{"a", "b", "d", "c"},
+			"",
+		},
+		// Self dependency
+		{
+			map[string][]string{"a": {"a"}},
+			ResolveOptions{},
+			nil,
+			"dependency cycle: example.com/a -> example.com/a",
+		},
+		// Transitive cycle
+		{
+			map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"b"}},
+			ResolveOptions{Dedup: true},
+			nil,
+			"dependency cycle: example.com/b -> example.com/c -> example.com/b",
+		},
+		// Maximum depth
+		{
+			map[string][]string{"a": {"b"}, "b": {"c"}, "c": nil},
+			ResolveOptions{MaxDepth: 2},
+			[]string{"a", "b", "c"},
+			"",
+		},
+		{
+			map[string][]string{"a": {"b"}, "b": {"c"}, "c": nil},
+			ResolveOptions{MaxDepth: 1},
+			nil,
+			"dependency tree of example.com/a exceeds the maximum depth of 1",
+		},
+	}
+
+	for i, tt := range tests {
+		dir, err := ioutil.TempDir("", tstprefix)
+		if err != nil {
+			t.Fatalf("error creating tempdir: %v", err)
+		}
+		ds := NewTestStore()
+		keys := make(map[string]string)
+		for name, deps := range tt.images {
+			var fullDeps []string
+			for _, d := range deps {
+				fullDeps = append(fullDeps, "example.com/"+d)
+			}
+			key, err := newManifestOnlyACI("example.com/"+name, fullDeps, dir, ds)
+			if err != nil {
+				t.Fatalf("#%d: unexpected error: %v", i, err)
+			}
+			keys[name] = key
+		}
+		os.RemoveAll(dir)
+
+		h, _ := types.NewHash(keys["a"])
+		imgs, err := CreateDepListFromImageIDWithOptions(*h, ds, tt.opts)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("#%d: got error %v, want %q", i, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		var names []string
+		for _, img := range imgs {
+			names = append(names, img.Im.Name.String()[len("example.com/"):])
+		}
+		if fmt.Sprint(names) != fmt.Sprint(tt.expected) {
+			t.Errorf("#%d: got images %v, want %v", i, names, tt.expected)
+		}
+	}
+}
+
+func TestCreateDepListDedupDiamonds(t *testing.T) {
+	dir, err := ioutil.TempDir("", tstprefix)
+	if err != nil {
+		t.Fatalf("error creating tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ds := NewTestStore()
+
+	// A chain of diamonds: each n image depends on the next one through
+	// both an l and an r image, 2^levels paths leading to the last one.
+	const levels = 64
+	var key string
+	for i := levels; i >= 0; i-- {
+		var deps []string
+		if i < levels {
+			next := fmt.Sprintf("example.com/n%d", i+1)
+			for _, side := range []string{"l", "r"} {
+				name := fmt.Sprintf("example.com/%s%d", side, i+1)
+				if _, err := newManifestOnlyACI(name, []string{next}, dir, ds); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				deps = append(deps, name)
+			}
+		}
+		key, err = newManifestOnlyACI(fmt.Sprintf("example.com/n%d", i), deps, dir, ds)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	h, _ := types.NewHash(key)
+	imgs, err := CreateDepListFromImageIDWithOptions(*h, ds, ResolveOptions{Dedup: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(imgs) != 3*levels+1 {
+		t.Errorf("got %d images, want %d", len(imgs), 3*levels+1)
+	}
+}
+
+func TestDependencySize(t *testing.T) {
+	dir, err := ioutil.TempDir("", tstprefix)
+	if err != nil {
+		t.Fatalf("error creating tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ds := NewTestStore()
+
+	baseKey, err := newManifestOnlyACI("example.com/base", nil, dir, ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	size := uint(len(ds.acis[baseKey].data))
+	h, _ := types.NewHash(baseKey)
+
+	tests := []struct {
+		size uint
+		werr bool
+	}{
+		{0, false},
+		{size, false},
+		{size - 1, true},
+		{size + 1, true},
+	}
+	for i, tt := range tests {
+		imj := `{"acKind": "ImageManifest", "acVersion": "0.8.11", "name": "example.com/app"}`
+		imj, err := addDependencies(imj, types.Dependency{ImageName: "example.com/base", ImageID: h, Size: tt.size})
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		entries := []*testTarEntry{
+			{contents: imj, header: &tar.Header{Name: "manifest", Size: int64(len(imj))}},
+		}
+		appKey, err := newTestACI(entries, dir, ds)
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+
+		ah, _ := types.NewHash(appKey)
+		imgs, err := CreateDepListFromImageID(*ah, ds)
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if imgs[1].Size != uint64(tt.size) {
+			t.Errorf("#%d: got size %d, want %d", i, imgs[1].Size, tt.size)
+		}
+		for _, parallelism := range []int{1, 2} {
+			_, err = GetRenderedACIFromListConcurrent(imgs, ds, parallelism)
+			if gerr := err != nil; gerr != tt.werr {
+				t.Errorf("#%d: parallelism %d: gerr=%t, want %t (err=%v)", i, parallelism, gerr, tt.werr, err)
+			}
+		}
+	}
+}
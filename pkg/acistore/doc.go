@@ -0,0 +1,35 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package acistore implements a content-addressed on-disk store of ACIs,
+// usable as an acirenderer.ACIRegistry.
+//
+// Images are keyed by their image ID, the sha512 hash of the uncompressed
+// ACI. The store directory contains:
+//
+//	blobs/KEY             the uncompressed ACI
+//	manifests/KEY         its image manifest
+//	index/NAME/KEY        an empty file per image, NAME being the escaped
+//	                      image name
+//	tags/TAG              the key of the image pinned by the escaped TAG
+//	tmp/                  the files being imported
+//	lock                  the lock file
+//
+// Files are written in tmp and renamed into place, so a reader never sees a
+// partial file. Several processes can use the same store: reads take a
+// shared lock on the lock file and writes an exclusive one.
+//
+// The package also provides a TreeCache, caching the rendered images in
+// another directory.
+package acistore
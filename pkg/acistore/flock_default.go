@@ -0,0 +1,25 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux,!freebsd,!netbsd,!openbsd,!darwin
+
+package acistore
+
+import "os"
+
+// flock does nothing: without file locking, the store is only safe to use
+// from a single process.
+func flock(f *os.File, exclusive bool) error {
+	return nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acistore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/appc/spec/pkg/acirenderer"
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+// staleTmpAge is the age after which a temporary file is considered left
+// over by an interrupted import. Files being imported are written
+// continuously, so they are always younger.
+const staleTmpAge = 24 * time.Hour
+
+// DefaultGCGracePeriod is the grace period used when GCOptions.GracePeriod
+// is zero. Import and Tag lock the store separately, so an image must
+// survive a collection running between the two.
+const DefaultGCGracePeriod = time.Hour
+
+// GCOptions tunes the garbage collection of a store.
+type GCOptions struct {
+	// Pods are the pod manifests whose images are kept, with their
+	// dependencies, in addition to the tagged ones.
+	Pods []*schema.PodManifest
+	// GracePeriod keeps the images imported (or imported again) less than
+	// GracePeriod ago, leaving time to tag them or to write the pod
+	// manifest using them after the import. Zero means
+	// DefaultGCGracePeriod and a negative value disables the grace period.
+	GracePeriod time.Duration
+	// DryRun only reports the images which would be removed.
+	DryRun bool
+}
+
+// GCResult reports the images removed by a garbage collection.
+type GCResult struct {
+	// Removed are the sorted keys of the removed images.
+	Removed []string
+	// Size is the total size of the removed uncompressed ACIs.
+	Size int64
+}
+
+// GC removes the images which are neither tagged, nor used by one of the
+// pods, nor a dependency of such an image, that is the images not found in
+// the flat dependency tree of a tagged or pod image. If one of the trees
+// cannot be resolved, nothing is removed.
+//
+// The store is locked during the collection, so concurrent imports wait
+// until it is done. An image imported just before the collection is kept if
+// it is younger than the grace period.
+func (s *Store) GC(opts GCOptions) (*GCResult, error) {
+	l, err := s.lock(true)
+	if err != nil {
+		return nil, err
+	}
+	defer l.unlock()
+
+	roots, err := s.gcRoots(opts.Pods)
+	if err != nil {
+		return nil, err
+	}
+	reachable := make(map[string]struct{})
+	for _, root := range roots {
+		if _, ok := reachable[root]; ok {
+			continue
+		}
+		h, err := types.NewHash(root)
+		if err != nil {
+			return nil, err
+		}
+		imgs, err := acirenderer.CreateDepListFromImageIDWithOptions(*h, lockedStore{s}, acirenderer.ResolveOptions{Dedup: true})
+		if err != nil {
+			return nil, fmt.Errorf("error resolving the dependencies of %s: %v", root, err)
+		}
+		for _, img := range imgs {
+			reachable[img.Key] = struct{}{}
+		}
+	}
+
+	keys, err := s.keys()
+	if err != nil {
+		return nil, err
+	}
+	grace := opts.GracePeriod
+	if grace == 0 {
+		grace = DefaultGCGracePeriod
+	}
+	now := time.Now()
+	res := &GCResult{}
+	for _, key := range keys {
+		if _, ok := reachable[key]; ok {
+			continue
+		}
+		fi, err := os.Stat(s.path(blobsDir, key))
+		if err != nil {
+			return nil, err
+		}
+		if now.Sub(fi.ModTime()) < grace {
+			continue
+		}
+		if !opts.DryRun {
+			if err := s.remove(key); err != nil {
+				return res, err
+			}
+		}
+		res.Removed = append(res.Removed, key)
+		res.Size += fi.Size()
+	}
+
+	if !opts.DryRun {
+		if err := s.removeStaleTmp(now); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// gcRoots returns the keys of the tagged images and of the images of the
+// pods. The images of the pods which are not in the store are ignored.
+func (s *Store) gcRoots(pods []*schema.PodManifest) ([]string, error) {
+	tags, err := s.tags()
+	if err != nil {
+		return nil, err
+	}
+	var roots []string
+	for _, key := range tags {
+		roots = append(roots, key)
+	}
+	for _, pm := range pods {
+		for _, ra := range pm.Apps {
+			if ra.Image.ID.Empty() {
+				continue
+			}
+			key, err := s.resolveKey(ra.Image.ID.String())
+			if err != nil {
+				continue
+			}
+			roots = append(roots, key)
+		}
+	}
+	return roots, nil
+}
+
+// remove removes an image in the reverse order of the import, so that an
+// indexed image is always complete.
+func (s *Store) remove(key string) error {
+	// The manifest is missing if the import of the image was interrupted.
+	im, err := s.getImageManifest(key)
+	if err == nil {
+		if err := os.Remove(filepath.Join(s.indexPath(im.Name), key)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		// only succeeds if no other image has the same name
+		os.Remove(s.indexPath(im.Name))
+	}
+	if err := os.Remove(s.path(manifestsDir, key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(s.path(blobsDir, key))
+}
+
+func (s *Store) removeStaleTmp(now time.Time) error {
+	fis, err := ioutil.ReadDir(s.path(tmpDir))
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if now.Sub(fi.ModTime()) < staleTmpAge {
+			continue
+		}
+		if err := os.Remove(s.path(tmpDir, fi.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acistore
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+func TestGC(t *testing.T) {
+	s, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+
+	keys := make(map[string]string)
+	add := func(name string, deps ...string) {
+		var d types.Dependencies
+		for _, dep := range deps {
+			d = append(d, types.Dependency{ImageName: types.ACIdentifier("example.com/" + dep)})
+		}
+		keys[name] = importACI(t, s, newTestACI(t, "example.com/"+name, "", d, name))
+	}
+	add("base")
+	add("lib", "base")
+	add("tagged", "lib")
+	add("podbase")
+	add("pod", "podbase")
+	add("orphan", "base")
+	add("orphanlib")
+	add("orphan2", "orphanlib")
+
+	if err := s.Tag("stable", keys["tagged"][:len("sha512-")+12]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h, _ := types.NewHash(keys["pod"])
+	pm := schema.BlankPodManifest()
+	pm.Apps = schema.AppList{{Name: "pod", Image: schema.RuntimeImage{ID: *h}}}
+	opts := GCOptions{Pods: []*schema.PodManifest{pm}, GracePeriod: -1}
+
+	expected := []string{keys["orphan"], keys["orphanlib"], keys["orphan2"]}
+	sort.Strings(expected)
+
+	// a dry run removes nothing
+	opts.DryRun = true
+	res, err := s.GC(opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(res.Removed) != fmt.Sprint(expected) {
+		t.Errorf("dry run: got removed %v, want %v", res.Removed, expected)
+	}
+	if res.Size <= 0 {
+		t.Errorf("dry run: got size %d, want a positive size", res.Size)
+	}
+	if all, _ := s.Keys(); len(all) != len(keys) {
+		t.Errorf("dry run: got %d images, want %d", len(all), len(keys))
+	}
+
+	// young images are kept
+	opts.DryRun = false
+	opts.GracePeriod = time.Hour
+	if res, err = s.GC(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(res.Removed) != 0 {
+		t.Errorf("grace period: got removed %v, want none", res.Removed)
+	}
+
+	// the default grace period keeps them too
+	opts.GracePeriod = 0
+	if res, err = s.GC(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(res.Removed) != 0 {
+		t.Errorf("default grace period: got removed %v, want none", res.Removed)
+	}
+
+	opts.GracePeriod = -1
+	if res, err = s.GC(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(res.Removed) != fmt.Sprint(expected) {
+		t.Errorf("got removed %v, want %v", res.Removed, expected)
+	}
+	all, err := s.Keys()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(all) != len(keys)-len(expected) {
+		t.Errorf("got %d images, want %d", len(all), len(keys)-len(expected))
+	}
+	if _, err := s.GetACI("example.com/orphan", nil); err == nil {
+		t.Errorf("example.com/orphan should not be found after the GC")
+	}
+	if _, err := s.GetACI("example.com/base", nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// once untagged, the tagged image and its dependencies are removed
+	if err := s.Untag("stable"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res, err = s.GC(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(res.Removed) != 3 {
+		t.Errorf("got removed %v, want the tagged image, lib and base", res.Removed)
+	}
+}
+
+func TestGCMissingDependency(t *testing.T) {
+	s, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+
+	deps := types.Dependencies{{ImageName: "example.com/missing"}}
+	key := importACI(t, s, newTestACI(t, "example.com/app", "", deps, "app"))
+	importACI(t, s, newTestACI(t, "example.com/orphan", "", nil, "orphan"))
+	if err := s.Tag("app", key); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := s.GC(GCOptions{}); err == nil {
+		t.Errorf("expected an error with a missing dependency")
+	}
+	if all, _ := s.Keys(); len(all) != 2 {
+		t.Errorf("got %d images, want 2: nothing should be removed", len(all))
+	}
+}
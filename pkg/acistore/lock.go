@@ -0,0 +1,74 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acistore
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const lockFile = "lock"
+
+// dirLock is a held lock of a directory.
+type dirLock struct {
+	mu        *sync.RWMutex
+	f         *os.File
+	exclusive bool
+}
+
+// lockDir locks the directory, exclusively or not, for the goroutines of
+// this process, using mu, and for other processes, using the lock file of
+// the directory. Each lock opens the lock file, as flock locks belong to the
+// open file and not to the process.
+func lockDir(dir string, mu *sync.RWMutex, exclusive bool) (*dirLock, error) {
+	if exclusive {
+		mu.Lock()
+	} else {
+		mu.RLock()
+	}
+	l := &dirLock{mu: mu, exclusive: exclusive}
+	f, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		l.unlockMutex()
+		return nil, err
+	}
+	if err := flock(f, exclusive); err != nil {
+		f.Close()
+		l.unlockMutex()
+		return nil, err
+	}
+	l.f = f
+	return l, nil
+}
+
+// lock locks the store.
+func (s *Store) lock(exclusive bool) (*dirLock, error) {
+	return lockDir(s.dir, &s.mu, exclusive)
+}
+
+// unlock releases the lock, closing the lock file releases the file lock.
+func (l *dirLock) unlock() {
+	l.f.Close()
+	l.unlockMutex()
+}
+
+func (l *dirLock) unlockMutex() {
+	if l.exclusive {
+		l.mu.Unlock()
+	} else {
+		l.mu.RUnlock()
+	}
+}
@@ -0,0 +1,346 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acistore
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/pkg/acirenderer"
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+const (
+	blobsDir     = "blobs"
+	manifestsDir = "manifests"
+	indexDir     = "index"
+	tmpDir       = "tmp"
+
+	keyPrefix = "sha512-"
+	keyLen    = len(keyPrefix) + sha512.Size*2
+)
+
+// Store is a content-addressed on-disk store of ACIs.
+type Store struct {
+	// Matcher chooses the image returned by GetACI among the images with
+	// the requested name.
+	Matcher *acirenderer.DependencyMatcher
+
+	dir string
+	mu  sync.RWMutex
+}
+
+var _ acirenderer.ACIRegistry = (*Store)(nil)
+
+// NewStore returns the store in the given directory, creating it if needed.
+// Its Matcher uses the os and arch of the host as default labels.
+func NewStore(dir string) (*Store, error) {
+	for _, d := range []string{blobsDir, manifestsDir, indexDir, tagsDir, tmpDir} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+	m, err := acirenderer.NewDependencyMatcher()
+	if err != nil {
+		m = &acirenderer.DependencyMatcher{}
+	}
+	return &Store{Matcher: m, dir: dir}, nil
+}
+
+func (s *Store) path(elem ...string) string {
+	return filepath.Join(append([]string{s.dir}, elem...)...)
+}
+
+// indexPath returns the index directory of the images with the given name.
+func (s *Store) indexPath(name types.ACIdentifier) string {
+	return s.path(indexDir, url.QueryEscape(name.String()))
+}
+
+// Import adds the given ACI, which may be compressed, to the store and
+// returns its image ID. If id is not nil, the image ID of the ACI must be id.
+// Importing an image already in the store does nothing.
+func (s *Store) Import(rs io.ReadSeeker, id *types.Hash) (*types.Hash, error) {
+	dr, err := aci.NewCompressedReader(rs)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+
+	tmp, err := ioutil.TempFile(s.path(tmpDir), "blob-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if tmp != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	h := sha512.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), dr); err != nil {
+		return nil, fmt.Errorf("error reading ACI: %v", err)
+	}
+	key := s.HashToKey(h)
+	if id != nil && !id.Empty() && id.String() != key {
+		return nil, fmt.Errorf("image ID does not match expected (%s != %s)", key, id)
+	}
+	im, err := aci.ManifestFromImage(tmp)
+	if err != nil {
+		return nil, err
+	}
+	imj, err := im.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return nil, err
+	}
+
+	l, err := s.lock(true)
+	if err != nil {
+		return nil, err
+	}
+	defer l.unlock()
+
+	// The blob comes first and the index entry last, so that an indexed
+	// image is always complete.
+	if err := os.Rename(tmp.Name(), s.path(blobsDir, key)); err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	tmp = nil
+	if err := s.writeFile(s.path(manifestsDir, key), imj); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.indexPath(im.Name), 0755); err != nil {
+		return nil, err
+	}
+	if err := s.writeFile(filepath.Join(s.indexPath(im.Name), key), nil); err != nil {
+		return nil, err
+	}
+	return types.NewHash(key)
+}
+
+// writeFile atomically writes the file at path.
+func (s *Store) writeFile(path string, b []byte) error {
+	return writeFileAtomic(s.path(tmpDir), path, b)
+}
+
+// writeFileAtomic writes the file at path by renaming a file written in
+// tmpDir.
+func writeFileAtomic(tmpDir, path string, b []byte) error {
+	f, err := ioutil.TempFile(tmpDir, "file-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// Keys returns the sorted keys of the images of the store.
+func (s *Store) Keys() ([]string, error) {
+	l, err := s.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer l.unlock()
+	return s.keys()
+}
+
+func (s *Store) keys() ([]string, error) {
+	fis, err := ioutil.ReadDir(s.path(blobsDir))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		keys = append(keys, fi.Name())
+	}
+	return keys, nil
+}
+
+// GetImageManifest returns the manifest of the image with the given key.
+func (s *Store) GetImageManifest(key string) (*schema.ImageManifest, error) {
+	l, err := s.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer l.unlock()
+	return s.getImageManifest(key)
+}
+
+func (s *Store) getImageManifest(key string) (*schema.ImageManifest, error) {
+	b, err := ioutil.ReadFile(s.path(manifestsDir, filepath.Base(key)))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("image %s not found", key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var im schema.ImageManifest
+	if err := im.UnmarshalJSON(b); err != nil {
+		return nil, fmt.Errorf("error parsing manifest of %s: %v", key, err)
+	}
+	return &im, nil
+}
+
+// GetACI returns the key of the image chosen by the Matcher among the images
+// with the given name, for a dependency with the given labels.
+func (s *Store) GetACI(name types.ACIdentifier, labels types.Labels) (string, error) {
+	l, err := s.lock(false)
+	if err != nil {
+		return "", err
+	}
+	defer l.unlock()
+	return s.getACI(name, labels)
+}
+
+func (s *Store) getACI(name types.ACIdentifier, labels types.Labels) (string, error) {
+	fis, err := ioutil.ReadDir(s.indexPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	var candidates []acirenderer.Candidate
+	for _, fi := range fis {
+		key := fi.Name()
+		h, err := types.NewHash(key)
+		if err != nil {
+			return "", err
+		}
+		im, err := s.getImageManifest(key)
+		if err != nil {
+			return "", err
+		}
+		candidates = append(candidates, acirenderer.Candidate{ImageID: *h, Manifest: im})
+	}
+	c, err := s.Matcher.Match(types.Dependency{ImageName: name, Labels: labels}, candidates)
+	if err != nil {
+		return "", err
+	}
+	return c.ImageID.String(), nil
+}
+
+// ReadStream returns the uncompressed ACI of the image with the given key.
+func (s *Store) ReadStream(key string) (io.ReadCloser, error) {
+	l, err := s.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer l.unlock()
+	return s.readStream(key)
+}
+
+func (s *Store) readStream(key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(blobsDir, filepath.Base(key)))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("image %s not found", key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ResolveKey returns the full key of the image whose key starts with the
+// given one, which must not match several images.
+func (s *Store) ResolveKey(key string) (string, error) {
+	l, err := s.lock(false)
+	if err != nil {
+		return "", err
+	}
+	defer l.unlock()
+	return s.resolveKey(key)
+}
+
+func (s *Store) resolveKey(key string) (string, error) {
+	if !strings.HasPrefix(key, keyPrefix) {
+		return "", fmt.Errorf("wrong key prefix in %q", key)
+	}
+	if len(key) == keyLen {
+		if _, err := os.Stat(s.path(blobsDir, filepath.Base(key))); err != nil {
+			if os.IsNotExist(err) {
+				return "", fmt.Errorf("image %s not found", key)
+			}
+			return "", err
+		}
+		return key, nil
+	}
+	keys, err := s.keys()
+	if err != nil {
+		return "", err
+	}
+	i := sort.SearchStrings(keys, key)
+	switch {
+	case i == len(keys) || !strings.HasPrefix(keys[i], key):
+		return "", fmt.Errorf("image %s not found", key)
+	case i+1 < len(keys) && strings.HasPrefix(keys[i+1], key):
+		return "", fmt.Errorf("ambiguous key %s", key)
+	}
+	return keys[i], nil
+}
+
+// HashToKey returns the key of the image whose ACI has the given sha512 hash.
+func (s *Store) HashToKey(h hash.Hash) string {
+	return fmt.Sprintf("%s%x", keyPrefix, h.Sum(nil))
+}
+
+// lockedStore is an acirenderer.ACIRegistry on a store already locked by the
+// caller.
+type lockedStore struct {
+	s *Store
+}
+
+func (ls lockedStore) GetImageManifest(key string) (*schema.ImageManifest, error) {
+	return ls.s.getImageManifest(key)
+}
+
+func (ls lockedStore) GetACI(name types.ACIdentifier, labels types.Labels) (string, error) {
+	return ls.s.getACI(name, labels)
+}
+
+func (ls lockedStore) ReadStream(key string) (io.ReadCloser, error) {
+	return ls.s.readStream(key)
+}
+
+func (ls lockedStore) ResolveKey(key string) (string, error) {
+	return ls.s.resolveKey(key)
+}
+
+func (ls lockedStore) HashToKey(h hash.Hash) string {
+	return ls.s.HashToKey(h)
+}
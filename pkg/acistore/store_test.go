@@ -0,0 +1,312 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acistore
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/appc/spec/pkg/acirenderer"
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+// newTestACI returns a gzipped ACI with the given name, version label and
+// dependencies, and a single rootfs/file with the given contents.
+func newTestACI(t *testing.T, name, version string, deps types.Dependencies, contents string) []byte {
+	im := schema.BlankImageManifest()
+	im.Name = types.ACIdentifier(name)
+	if version != "" {
+		im.Labels = types.Labels{{Name: "version", Value: version}}
+	}
+	im.Dependencies = deps
+	imj, err := im.MarshalJSON()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	files := []struct {
+		hdr      *tar.Header
+		contents string
+	}{
+		{&tar.Header{Name: "manifest", Mode: 0644, Size: int64(len(imj))}, string(imj)},
+		{&tar.Header{Name: "rootfs", Mode: 0755, Typeflag: tar.TypeDir}, ""},
+		{&tar.Header{Name: "rootfs/file", Mode: 0644, Size: int64(len(contents))}, contents},
+	}
+	for _, f := range files {
+		if err := tw.WriteHeader(f.hdr); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := tw.Write([]byte(f.contents)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func newTestStore(t *testing.T) (*Store, string) {
+	dir, err := ioutil.TempDir("", "acistore-test")
+	if err != nil {
+		t.Fatalf("error creating tempdir: %v", err)
+	}
+	s, err := NewStore(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return s, dir
+}
+
+func importACI(t *testing.T, s *Store, b []byte) string {
+	h, err := s.Import(bytes.NewReader(b), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return h.String()
+}
+
+func TestImport(t *testing.T) {
+	s, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+
+	b := newTestACI(t, "example.com/app", "1.0.0", nil, "app")
+	key := importACI(t, s, b)
+
+	rs, err := s.ReadStream(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := ioutil.ReadAll(rs)
+	rs.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if g := fmt.Sprintf("sha512-%x", sha512.Sum512(data)); g != key {
+		t.Errorf("got stream with hash %s, want %s", g, key)
+	}
+	im, err := s.GetImageManifest(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if im.Name != "example.com/app" {
+		t.Errorf("got manifest of %s, want example.com/app", im.Name)
+	}
+
+	// importing again, with the right image ID, does nothing
+	h, _ := types.NewHash(key)
+	if _, err := s.Import(bytes.NewReader(b), h); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	keys, err := s.Keys()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 1 || keys[0] != key {
+		t.Errorf("got keys %v, want [%s]", keys, key)
+	}
+
+	other := newTestACI(t, "example.com/app", "2.0.0", nil, "app")
+	if _, err := s.Import(bytes.NewReader(other), h); err == nil {
+		t.Errorf("expected an error importing an ACI with another image ID")
+	}
+	if _, err := s.Import(bytes.NewReader([]byte("not an ACI")), nil); err == nil {
+		t.Errorf("expected an error importing an invalid ACI")
+	}
+	if keys, _ := s.Keys(); len(keys) != 1 {
+		t.Errorf("got %d images after failed imports, want 1", len(keys))
+	}
+}
+
+func TestGetACI(t *testing.T) {
+	s, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+
+	keys := make(map[string]string)
+	for _, v := range []string{"1.0.0", "1.2.0", "2.0.0"} {
+		keys[v] = importACI(t, s, newTestACI(t, "example.com/app", v, nil, v))
+	}
+	importACI(t, s, newTestACI(t, "example.com/other", "3.0.0", nil, "other"))
+
+	tests := []struct {
+		name     types.ACIdentifier
+		version  string
+		expected string
+	}{
+		{"example.com/app", "", keys["2.0.0"]},
+		{"example.com/app", "latest", keys["2.0.0"]},
+		{"example.com/app", "1.0.0", keys["1.0.0"]},
+		{"example.com/app", ">=1.0.0, <2.0.0", keys["1.2.0"]},
+		{"example.com/app", "3.0.0", ""},
+		{"example.com/unknown", "", ""},
+	}
+	for i, tt := range tests {
+		var labels types.Labels
+		if tt.version != "" {
+			labels = types.Labels{{Name: "version", Value: tt.version}}
+		}
+		key, err := s.GetACI(tt.name, labels)
+		if tt.expected == "" {
+			if err == nil {
+				t.Errorf("#%d: expected an error, got %s", i, key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if key != tt.expected {
+			t.Errorf("#%d: got %s, want %s", i, key, tt.expected)
+		}
+	}
+}
+
+func TestResolveKey(t *testing.T) {
+	s, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+
+	key := importACI(t, s, newTestACI(t, "example.com/app", "", nil, "a"))
+	importACI(t, s, newTestACI(t, "example.com/app", "", nil, "b"))
+
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{key, key},
+		{key[:len("sha512-")+16], key},
+		{"sha512-", ""},
+		{"sha512-" + string(bytes.Repeat([]byte("0"), 128)), ""},
+		{key[len("sha512-"):], ""},
+	}
+	for i, tt := range tests {
+		g, err := s.ResolveKey(tt.key)
+		if tt.expected == "" {
+			if err == nil {
+				t.Errorf("#%d: expected an error, got %s", i, g)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if g != tt.expected {
+			t.Errorf("#%d: got %s, want %s", i, g, tt.expected)
+		}
+	}
+}
+
+func TestRenderFromStore(t *testing.T) {
+	s, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+
+	importACI(t, s, newTestACI(t, "example.com/base", "1.0.0", nil, "base"))
+	deps := types.Dependencies{{ImageName: "example.com/base"}}
+	appKey := importACI(t, s, newTestACI(t, "example.com/app", "1.0.0", deps, "app"))
+
+	h, _ := types.NewHash(appKey)
+	renderedACI, err := acirenderer.GetRenderedACIWithImageID(*h, s)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(renderedACI) != 2 {
+		t.Fatalf("got %d rendered images, want 2", len(renderedACI))
+	}
+	if _, ok := renderedACI[0].FileMap["rootfs/file"]; !ok {
+		t.Errorf("rootfs/file should be rendered from the app image")
+	}
+	if _, ok := renderedACI[1].FileMap["rootfs/file"]; ok {
+		t.Errorf("rootfs/file should not be rendered from the base image")
+	}
+}
+
+func TestConcurrentImport(t *testing.T) {
+	s, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+
+	const n = 8
+	acis := make([][]byte, n)
+	for i := range acis {
+		acis[i] = newTestACI(t, "example.com/app", fmt.Sprintf("1.%d.0", i), nil, "app")
+	}
+
+	// A second Store on the same directory behaves like another process.
+	s2, err := NewStore(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		st := s
+		if i%2 == 1 {
+			st = s2
+		}
+		wg.Add(2)
+		go func(st *Store, b []byte) {
+			defer wg.Done()
+			if _, err := st.Import(bytes.NewReader(b), nil); err != nil {
+				errs <- err
+			}
+		}(st, acis[i])
+		go func(st *Store) {
+			defer wg.Done()
+			key, err := st.GetACI("example.com/app", nil)
+			if err != nil {
+				// no image imported yet
+				return
+			}
+			if _, err := st.GetImageManifest(key); err != nil {
+				errs <- err
+			}
+		}(st)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	keys, err := s.Keys()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != n {
+		t.Errorf("got %d images, want %d", len(keys), n)
+	}
+	fis, err := ioutil.ReadDir(s.path(tmpDir))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(fis) != 0 {
+		t.Errorf("got %d files left in the temporary directory", len(fis))
+	}
+}
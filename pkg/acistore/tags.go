@@ -0,0 +1,96 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acistore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const tagsDir = "tags"
+
+func (s *Store) tagPath(tag string) string {
+	return s.path(tagsDir, url.QueryEscape(tag))
+}
+
+// Tag pins the image with the given key, which may be shortened, under the
+// given tag, replacing the image previously pinned by the tag. The garbage
+// collector keeps the tagged images and their dependencies.
+func (s *Store) Tag(tag, key string) error {
+	if tag == "" {
+		return fmt.Errorf("empty tag")
+	}
+	l, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+
+	key, err = s.resolveKey(key)
+	if err != nil {
+		return err
+	}
+	return s.writeFile(s.tagPath(tag), []byte(key))
+}
+
+// Untag removes the given tag.
+func (s *Store) Untag(tag string) error {
+	l, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+
+	if err := os.Remove(s.tagPath(tag)); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("tag %q not found", tag)
+		}
+		return err
+	}
+	return nil
+}
+
+// Tags returns the key of the image pinned by every tag.
+func (s *Store) Tags() (map[string]string, error) {
+	l, err := s.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer l.unlock()
+	return s.tags()
+}
+
+func (s *Store) tags() (map[string]string, error) {
+	fis, err := ioutil.ReadDir(s.path(tagsDir))
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string)
+	for _, fi := range fis {
+		tag, err := url.QueryUnescape(fi.Name())
+		if err != nil {
+			return nil, fmt.Errorf("bad tag file %q: %v", fi.Name(), err)
+		}
+		b, err := ioutil.ReadFile(s.path(tagsDir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		tags[tag] = strings.TrimSpace(string(b))
+	}
+	return tags, nil
+}
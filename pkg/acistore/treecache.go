@@ -0,0 +1,343 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acistore
+
+import (
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/appc/spec/pkg/acirenderer"
+	"github.com/appc/spec/schema/types"
+)
+
+const (
+	treesDir = "trees"
+	infoDir  = "info"
+)
+
+// TreeCache is an on-disk cache of rendered images, keyed by image ID. The
+// cache directory contains:
+//
+//	trees/KEY     the image rendered with its dependencies, in the ACI
+//	              layout
+//	info/KEY      the digest and the size of the tree, its modification
+//	              time being the last time the tree was used
+//	tmp/          the trees being rendered
+//	lock          the lock file
+//
+// A tree is verified against its digest every time it is reused, a tree
+// whose digest does not match, for example because it was modified or not
+// completely written, is rendered again. The verification reads the whole
+// tree, so it costs about as much as hashing the uncompressed image on
+// every Get; SkipVerify trades it for trusting the trees on disk.
+type TreeCache struct {
+	// MaxSize is the total size of the trees above which the least
+	// recently used trees are removed, by Get after rendering a tree and
+	// by Evict. Zero means no limit.
+	MaxSize int64
+	// SkipVerify reuses a tree whose info exists without checking its
+	// digest. A tree not completely written is still rendered again, as
+	// its info is written last.
+	SkipVerify bool
+
+	dir string
+	mu  sync.RWMutex
+}
+
+type treeInfo struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// NewTreeCache returns the tree cache in the given directory, creating it
+// if needed.
+func NewTreeCache(dir string, maxSize int64) (*TreeCache, error) {
+	for _, d := range []string{treesDir, infoDir, tmpDir} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &TreeCache{MaxSize: maxSize, dir: dir}, nil
+}
+
+func (c *TreeCache) path(elem ...string) string {
+	return filepath.Join(append([]string{c.dir}, elem...)...)
+}
+
+// Get returns the directory of the rendered image with the given image ID,
+// rendering it from ap if it is not cached or fails verification.
+//
+// The returned tree must not be modified. It stays valid until it is
+// evicted: when a tree is rendered and the total size exceeds MaxSize, the
+// least recently used trees other than the new one are removed, so the
+// trees kept in use for long should be used again, or MaxSize left at zero
+// and Evict only called when the trees are not in use.
+func (c *TreeCache) Get(id types.Hash, ap acirenderer.ACIRegistry) (string, error) {
+	key, err := ap.ResolveKey(id.String())
+	if err != nil {
+		return "", err
+	}
+
+	l, err := lockDir(c.dir, &c.mu, false)
+	if err != nil {
+		return "", err
+	}
+	ok, err := c.check(key)
+	l.unlock()
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return c.path(treesDir, key), nil
+	}
+
+	l, err = lockDir(c.dir, &c.mu, true)
+	if err != nil {
+		return "", err
+	}
+	// the tree may have been rendered while waiting for the lock
+	ok, err = c.check(key)
+	if err == nil && !ok {
+		err = c.render(key, ap)
+	}
+	l.unlock()
+	if err != nil {
+		return "", err
+	}
+	if !ok && c.MaxSize > 0 {
+		if err := c.evict(key); err != nil {
+			return "", err
+		}
+	}
+	return c.path(treesDir, key), nil
+}
+
+// check returns whether the tree of key is cached and, unless SkipVerify is
+// set, matches its digest, marking it as used if so.
+func (c *TreeCache) check(key string) (bool, error) {
+	b, err := ioutil.ReadFile(c.path(infoDir, key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var info treeInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		return false, nil
+	}
+	if c.SkipVerify {
+		if _, err := os.Stat(c.path(treesDir, key)); err != nil {
+			return false, nil
+		}
+	} else {
+		digest, _, err := treeDigest(c.path(treesDir, key))
+		if err != nil || digest != info.Digest {
+			return false, nil
+		}
+	}
+	now := time.Now()
+	if err := os.Chtimes(c.path(infoDir, key), now, now); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// render renders the image of key in a temporary directory, then moves it
+// in place of the previous tree, if any, and writes its info.
+func (c *TreeCache) render(key string, ap acirenderer.ACIRegistry) error {
+	if err := c.remove(key); err != nil {
+		return err
+	}
+	h, err := types.NewHash(key)
+	if err != nil {
+		return err
+	}
+	renderedACI, err := acirenderer.GetRenderedACIWithImageID(*h, ap)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(c.path(tmpDir), "tree-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return err
+	}
+	if err := acirenderer.RenderToDir(renderedACI, ap, tmp); err != nil {
+		return err
+	}
+	digest, size, err := treeDigest(tmp)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(treeInfo{Digest: digest, Size: size})
+	if err != nil {
+		return err
+	}
+	// A tree without info is never used, so the info comes last.
+	if err := os.Rename(tmp, c.path(treesDir, key)); err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path(tmpDir), c.path(infoDir, key), b)
+}
+
+// remove removes the tree of key, the info first.
+func (c *TreeCache) remove(key string) error {
+	if err := os.Remove(c.path(infoDir, key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(c.path(treesDir, key))
+}
+
+type cachedTree struct {
+	key      string
+	size     int64
+	lastUsed time.Time
+}
+
+// Evict removes the least recently used trees until the total size of the
+// trees is at most MaxSize, and the trees left over by interrupted renders.
+func (c *TreeCache) Evict() error {
+	return c.evict("")
+}
+
+// evict implements Evict, never removing the tree of keep.
+func (c *TreeCache) evict(keep string) error {
+	l, err := lockDir(c.dir, &c.mu, true)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+
+	fis, err := ioutil.ReadDir(c.path(treesDir))
+	if err != nil {
+		return err
+	}
+	var trees []cachedTree
+	var total int64
+	for _, fi := range fis {
+		key := fi.Name()
+		ifi, err := os.Stat(c.path(infoDir, key))
+		var info treeInfo
+		if err == nil {
+			var b []byte
+			if b, err = ioutil.ReadFile(c.path(infoDir, key)); err == nil {
+				err = json.Unmarshal(b, &info)
+			}
+		}
+		if err != nil {
+			if err := c.remove(key); err != nil {
+				return err
+			}
+			continue
+		}
+		trees = append(trees, cachedTree{key: key, size: info.Size, lastUsed: ifi.ModTime()})
+		total += info.Size
+	}
+	if err := removeAll(c.path(tmpDir)); err != nil {
+		return err
+	}
+	if c.MaxSize <= 0 {
+		return nil
+	}
+
+	sort.Sort(treesByLastUse(trees))
+	for _, t := range trees {
+		if total <= c.MaxSize {
+			break
+		}
+		if t.key == keep {
+			continue
+		}
+		if err := c.remove(t.key); err != nil {
+			return err
+		}
+		total -= t.size
+	}
+	return nil
+}
+
+type treesByLastUse []cachedTree
+
+func (t treesByLastUse) Len() int           { return len(t) }
+func (t treesByLastUse) Less(i, j int) bool { return t[i].lastUsed.Before(t[j].lastUsed) }
+func (t treesByLastUse) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// removeAll removes the contents of dir.
+func removeAll(dir string) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if err := os.RemoveAll(filepath.Join(dir, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeDigest returns the digest of the tree in dir and its size. The digest
+// is the sha512 hash of the path, mode, owner, link target and contents of
+// every file, in lexical order.
+func treeDigest(dir string) (string, int64, error) {
+	h := sha512.New()
+	var size int64
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		uid, gid := fileOwner(fi)
+		fmt.Fprintf(h, "%s\x00%o\x00%d:%d\x00", rel, uint32(fi.Mode()), uid, gid)
+		size += fi.Size()
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00", target)
+		case fi.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			fmt.Fprintf(h, "%d\x00", fi.Size())
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("sha512-%x", h.Sum(nil)), size, nil
+}
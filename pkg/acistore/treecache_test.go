@@ -0,0 +1,177 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acistore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+)
+
+func TestTreeCache(t *testing.T) {
+	s, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	c, err := NewTreeCache(filepath.Join(dir, "trees"), 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	importACI(t, s, newTestACI(t, "example.com/base", "", nil, "base"))
+	deps := types.Dependencies{{ImageName: "example.com/base"}}
+	key := importACI(t, s, newTestACI(t, "example.com/app", "", deps, "app"))
+	h, _ := types.NewHash(key)
+
+	checkTree := func(msg string) string {
+		path, err := c.Get(*h, s)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", msg, err)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(path, "rootfs/file"))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", msg, err)
+		}
+		if string(b) != "app" {
+			t.Errorf("%s: got rootfs/file %q, want %q", msg, b, "app")
+		}
+		return path
+	}
+
+	path := checkTree("first render")
+	info := c.path(infoDir, key)
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(info, old, old); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p := checkTree("reuse"); p != path {
+		t.Errorf("got tree %s, want %s", p, path)
+	}
+	if fi, err := os.Stat(info); err != nil || !fi.ModTime().After(old) {
+		t.Errorf("reusing a tree should mark it as used")
+	}
+
+	// tampering is detected and the tree rendered again
+	if err := ioutil.WriteFile(filepath.Join(path, "rootfs/file"), []byte("evil"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	checkTree("tampered tree")
+	if err := os.Symlink("file", filepath.Join(path, "rootfs/link")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	checkTree("added file")
+	if _, err := os.Lstat(filepath.Join(path, "rootfs/link")); !os.IsNotExist(err) {
+		t.Errorf("rootfs/link should be removed by the new render")
+	}
+	if os.Getuid() == 0 {
+		if err := os.Lchown(filepath.Join(path, "rootfs/file"), 1, 1); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		checkTree("changed owner")
+		fi, err := os.Stat(filepath.Join(path, "rootfs/file"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if uid, _ := fileOwner(fi); uid == 1 {
+			t.Errorf("a tree whose owner changed should be rendered again")
+		}
+	}
+
+	// without verification, a modified tree is reused
+	c.SkipVerify = true
+	if err := os.Chmod(filepath.Join(path, "rootfs/file"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	checkTree("skip verify")
+	if fi, err := os.Stat(filepath.Join(path, "rootfs/file")); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("a modified tree should be reused with SkipVerify")
+	}
+	c.SkipVerify = false
+
+	// a tree without info is incomplete
+	if err := os.Remove(info); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	checkTree("incomplete tree")
+}
+
+func TestTreeCacheEvict(t *testing.T) {
+	s, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	c, err := NewTreeCache(filepath.Join(dir, "trees"), 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var keys []string
+	var size int64
+	for i, name := range []string{"a", "b", "c"} {
+		key := importACI(t, s, newTestACI(t, "example.com/"+name, "", nil, name))
+		h, _ := types.NewHash(key)
+		if _, err := c.Get(*h, s); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// b is the least recently used, then a
+		used := time.Now().Add(-time.Duration(3-i) * time.Hour)
+		if name == "b" {
+			used = used.Add(-2 * time.Hour)
+		}
+		if err := os.Chtimes(c.path(infoDir, key), used, used); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		_, size, err = treeDigest(c.path(treesDir, key))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	// a partial tree
+	if err := os.Mkdir(c.path(treesDir, "sha512-partial"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// all the trees have the same size, only one is kept
+	c.MaxSize = size + size/2
+	if err := c.Evict(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fis, err := ioutil.ReadDir(c.path(treesDir))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(fis) != 1 || fis[0].Name() != keys[2] {
+		var names []string
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+		t.Errorf("got trees %v, want [%s]", names, keys[2])
+	}
+
+	// rendering a new tree evicts the least recently used ones
+	key := importACI(t, s, newTestACI(t, "example.com/d", "", nil, "d"))
+	h, _ := types.NewHash(key)
+	path, err := c.Get(*h, s)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("the new tree should be kept: %v", err)
+	}
+	if _, err := os.Stat(c.path(treesDir, keys[2])); !os.IsNotExist(err) {
+		t.Errorf("the tree of c should be evicted by Get")
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/appc/spec/schema/types"
+)
+
+// ChangeType describes how a manifest field differs between two manifests.
+type ChangeType string
+
+const (
+	ChangeAdded    = ChangeType("added")
+	ChangeRemoved  = ChangeType("removed")
+	ChangeModified = ChangeType("modified")
+)
+
+// A Change describes a single difference between two manifests. Path
+// identifies the field using the JSON field names of the manifest; members of
+// keyed sets (labels, annotations, isolators, ...) are identified by their key
+// between square brackets, for example "app.isolators[resource/memory]".
+// Old is nil for added fields and New is nil for removed ones.
+type Change struct {
+	Path string      `json:"path"`
+	Type ChangeType  `json:"type"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// String returns a one line, human readable, representation of the change.
+func (c Change) String() string {
+	switch c.Type {
+	case ChangeAdded:
+		return fmt.Sprintf("+ %s: %s", c.Path, formatDiffValue(c.New))
+	case ChangeRemoved:
+		return fmt.Sprintf("- %s: %s", c.Path, formatDiffValue(c.Old))
+	default:
+		return fmt.Sprintf("~ %s: %s -> %s", c.Path, formatDiffValue(c.Old), formatDiffValue(c.New))
+	}
+}
+
+// ManifestDiff is the ordered list of changes between two manifests. An empty
+// ManifestDiff means the manifests are semantically equal.
+type ManifestDiff []Change
+
+// DiffImageManifests compares two image manifests field by field. Labels,
+// annotations, isolators, ports, environment variables, mount points, event
+// handlers and dependencies are compared as sets keyed by their name, so
+// reordering them is not reported as a change, with the exception of
+// dependencies whose order is significant.
+func DiffImageManifests(a, b *ImageManifest) ManifestDiff {
+	d := &differ{}
+	d.value("acKind", a.ACKind, b.ACKind)
+	d.value("acVersion", a.ACVersion, b.ACVersion)
+	d.value("name", a.Name, b.Name)
+	d.keyed("labels", labelsToMap(a.Labels), labelsToMap(b.Labels))
+	d.app("app", a.App, b.App)
+	d.keyed("annotations", annotationsToMap(a.Annotations), annotationsToMap(b.Annotations))
+	d.dependencies("dependencies", a.Dependencies, b.Dependencies)
+	d.keyed("pathWhitelist", stringsToSet(a.PathWhitelist), stringsToSet(b.PathWhitelist))
+	return d.changes
+}
+
+// DiffPodManifests compares two pod manifests field by field. Apps are
+// matched by name and their mounts by path; volumes, ports, isolators and
+// annotations are compared as sets keyed by their name.
+func DiffPodManifests(a, b *PodManifest) ManifestDiff {
+	d := &differ{}
+	d.value("acKind", a.ACKind, b.ACKind)
+	d.value("acVersion", a.ACVersion, b.ACVersion)
+
+	aApps := make(map[string]interface{})
+	for _, ra := range a.Apps {
+		aApps[ra.Name.String()] = ra
+	}
+	bApps := make(map[string]interface{})
+	for _, ra := range b.Apps {
+		bApps[ra.Name.String()] = ra
+	}
+	for _, name := range unionKeys(aApps, bApps) {
+		path := fmt.Sprintf("apps[%s]", name)
+		ara, aok := aApps[name]
+		bra, bok := bApps[name]
+		if !aok || !bok {
+			d.keyed("apps", pick(aApps, name), pick(bApps, name))
+			continue
+		}
+		d.runtimeApp(path, ara.(RuntimeApp), bra.(RuntimeApp))
+	}
+
+	aVols := make(map[string]interface{})
+	for _, v := range a.Volumes {
+		aVols[v.Name.String()] = v
+	}
+	bVols := make(map[string]interface{})
+	for _, v := range b.Volumes {
+		bVols[v.Name.String()] = v
+	}
+	d.keyed("volumes", aVols, bVols)
+	d.keyed("isolators", isolatorsToMap(a.Isolators), isolatorsToMap(b.Isolators))
+	d.keyed("annotations", annotationsToMap(a.Annotations), annotationsToMap(b.Annotations))
+
+	aPorts := make(map[string]interface{})
+	for _, p := range a.Ports {
+		aPorts[p.Name.String()] = p
+	}
+	bPorts := make(map[string]interface{})
+	for _, p := range b.Ports {
+		bPorts[p.Name.String()] = p
+	}
+	d.keyed("ports", aPorts, bPorts)
+	d.keyed("userAnnotations", stringMapToMap(a.UserAnnotations), stringMapToMap(b.UserAnnotations))
+	d.keyed("userLabels", stringMapToMap(a.UserLabels), stringMapToMap(b.UserLabels))
+	return d.changes
+}
+
+// differ accumulates the changes found while comparing two manifests.
+type differ struct {
+	changes ManifestDiff
+}
+
+func (d *differ) add(path string, typ ChangeType, oldValue, newValue interface{}) {
+	d.changes = append(d.changes, Change{Path: path, Type: typ, Old: oldValue, New: newValue})
+}
+
+// value compares two values of the same field and records a modification if
+// they differ.
+func (d *differ) value(path string, a, b interface{}) {
+	if !sameDiffValue(a, b) {
+		d.add(path, ChangeModified, a, b)
+	}
+}
+
+// keyed compares two sets of values keyed by name.
+func (d *differ) keyed(path string, a, b map[string]interface{}) {
+	for _, k := range unionKeys(a, b) {
+		kpath := fmt.Sprintf("%s[%s]", path, k)
+		av, aok := a[k]
+		bv, bok := b[k]
+		switch {
+		case aok && !bok:
+			d.add(kpath, ChangeRemoved, av, nil)
+		case !aok && bok:
+			d.add(kpath, ChangeAdded, nil, bv)
+		default:
+			d.value(kpath, av, bv)
+		}
+	}
+}
+
+func (d *differ) app(path string, a, b *types.App) {
+	switch {
+	case a == nil && b == nil:
+		return
+	case a == nil:
+		d.add(path, ChangeAdded, nil, b)
+		return
+	case b == nil:
+		d.add(path, ChangeRemoved, a, nil)
+		return
+	}
+	d.value(path+".exec", a.Exec, b.Exec)
+
+	aEHs := make(map[string]interface{})
+	for _, eh := range a.EventHandlers {
+		aEHs[eh.Name] = eh
+	}
+	bEHs := make(map[string]interface{})
+	for _, eh := range b.EventHandlers {
+		bEHs[eh.Name] = eh
+	}
+	d.keyed(path+".eventHandlers", aEHs, bEHs)
+
+	d.value(path+".user", a.User, b.User)
+	d.value(path+".group", a.Group, b.Group)
+	d.value(path+".supplementaryGIDs", a.SupplementaryGIDs, b.SupplementaryGIDs)
+	d.value(path+".workingDirectory", a.WorkingDirectory, b.WorkingDirectory)
+
+	aEnv := make(map[string]interface{})
+	for _, env := range a.Environment {
+		aEnv[env.Name] = env.Value
+	}
+	bEnv := make(map[string]interface{})
+	for _, env := range b.Environment {
+		bEnv[env.Name] = env.Value
+	}
+	d.keyed(path+".environment", aEnv, bEnv)
+
+	aMPs := make(map[string]interface{})
+	for _, mp := range a.MountPoints {
+		aMPs[mp.Name.String()] = mp
+	}
+	bMPs := make(map[string]interface{})
+	for _, mp := range b.MountPoints {
+		bMPs[mp.Name.String()] = mp
+	}
+	d.keyed(path+".mountPoints", aMPs, bMPs)
+
+	aPorts := make(map[string]interface{})
+	for _, p := range a.Ports {
+		aPorts[p.Name.String()] = p
+	}
+	bPorts := make(map[string]interface{})
+	for _, p := range b.Ports {
+		bPorts[p.Name.String()] = p
+	}
+	d.keyed(path+".ports", aPorts, bPorts)
+
+	d.keyed(path+".isolators", isolatorsToMap(a.Isolators), isolatorsToMap(b.Isolators))
+	d.keyed(path+".userAnnotations", stringMapToMap(a.UserAnnotations), stringMapToMap(b.UserAnnotations))
+	d.keyed(path+".userLabels", stringMapToMap(a.UserLabels), stringMapToMap(b.UserLabels))
+}
+
+// dependencies compares two dependency lists keyed by image name. As the
+// order of dependencies is significant, a change of the order of the
+// dependencies present in both lists is also reported.
+func (d *differ) dependencies(path string, a, b types.Dependencies) {
+	am := make(map[string]interface{})
+	var aOrder []string
+	for _, dep := range a {
+		am[dep.ImageName.String()] = dep
+		aOrder = append(aOrder, dep.ImageName.String())
+	}
+	bm := make(map[string]interface{})
+	var bOrder []string
+	for _, dep := range b {
+		bm[dep.ImageName.String()] = dep
+		bOrder = append(bOrder, dep.ImageName.String())
+	}
+	d.keyed(path, am, bm)
+
+	var aCommon, bCommon []string
+	for _, n := range aOrder {
+		if _, ok := bm[n]; ok {
+			aCommon = append(aCommon, n)
+		}
+	}
+	for _, n := range bOrder {
+		if _, ok := am[n]; ok {
+			bCommon = append(bCommon, n)
+		}
+	}
+	if !reflect.DeepEqual(aCommon, bCommon) {
+		d.add(path+".order", ChangeModified, aCommon, bCommon)
+	}
+}
+
+func (d *differ) runtimeApp(path string, a, b RuntimeApp) {
+	d.value(path+".image.name", a.Image.Name, b.Image.Name)
+	d.value(path+".image.id", a.Image.ID, b.Image.ID)
+	d.keyed(path+".image.labels", labelsToMap(a.Image.Labels), labelsToMap(b.Image.Labels))
+	d.app(path+".app", a.App, b.App)
+	d.value(path+".readOnlyRootFS", a.ReadOnlyRootFS, b.ReadOnlyRootFS)
+
+	aMounts := make(map[string]interface{})
+	for _, m := range a.Mounts {
+		aMounts[m.Path] = m
+	}
+	bMounts := make(map[string]interface{})
+	for _, m := range b.Mounts {
+		bMounts[m.Path] = m
+	}
+	d.keyed(path+".mounts", aMounts, bMounts)
+	d.keyed(path+".annotations", annotationsToMap(a.Annotations), annotationsToMap(b.Annotations))
+}
+
+func labelsToMap(labels types.Labels) map[string]interface{} {
+	m := make(map[string]interface{}, len(labels))
+	for _, l := range labels {
+		m[l.Name.String()] = l.Value
+	}
+	return m
+}
+
+func annotationsToMap(annotations types.Annotations) map[string]interface{} {
+	m := make(map[string]interface{}, len(annotations))
+	for _, a := range annotations {
+		m[a.Name.String()] = a.Value
+	}
+	return m
+}
+
+// isolatorsToMap returns the raw values of the isolators keyed by name. As
+// some isolator types can be specified multiple times, the values of an
+// isolator type specified more than once are collected in a list.
+func isolatorsToMap(isolators types.Isolators) map[string]interface{} {
+	byName := make(map[string][]json.RawMessage)
+	for _, i := range isolators {
+		var raw json.RawMessage
+		if i.ValueRaw != nil {
+			raw = *i.ValueRaw
+		}
+		byName[i.Name.String()] = append(byName[i.Name.String()], raw)
+	}
+	m := make(map[string]interface{}, len(byName))
+	for n, raws := range byName {
+		if len(raws) == 1 {
+			m[n] = raws[0]
+		} else {
+			m[n] = raws
+		}
+	}
+	return m
+}
+
+func stringMapToMap(sm map[string]string) map[string]interface{} {
+	m := make(map[string]interface{}, len(sm))
+	for k, v := range sm {
+		m[k] = v
+	}
+	return m
+}
+
+func stringsToSet(s []string) map[string]interface{} {
+	m := make(map[string]interface{}, len(s))
+	for _, e := range s {
+		m[e] = e
+	}
+	return m
+}
+
+// pick returns a map containing only the given key of m, if present.
+func pick(m map[string]interface{}, k string) map[string]interface{} {
+	if v, ok := m[k]; ok {
+		return map[string]interface{}{k: v}
+	}
+	return nil
+}
+
+// unionKeys returns the sorted union of the keys of a and b.
+func unionKeys(a, b map[string]interface{}) []string {
+	seen := make(map[string]struct{}, len(a)+len(b))
+	for k := range a {
+		seen[k] = struct{}{}
+	}
+	for k := range b {
+		seen[k] = struct{}{}
+	}
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sameDiffValue compares two values by their JSON representation, falling
+// back to a deep comparison for values which cannot be marshalled (like
+// values failing validation).
+func sameDiffValue(a, b interface{}) bool {
+	aj, aerr := json.Marshal(a)
+	bj, berr := json.Marshal(b)
+	if aerr != nil || berr != nil {
+		return reflect.DeepEqual(a, b)
+	}
+	var ac, bc bytes.Buffer
+	if json.Compact(&ac, aj) != nil || json.Compact(&bc, bj) != nil {
+		return bytes.Equal(aj, bj)
+	}
+	return bytes.Equal(ac.Bytes(), bc.Bytes())
+}
+
+func formatDiffValue(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return strconv.Quote(fmt.Sprintf("%v", v))
+	}
+	var c bytes.Buffer
+	if err := json.Compact(&c, b); err != nil {
+		return string(b)
+	}
+	return c.String()
+}
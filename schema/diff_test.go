@@ -0,0 +1,200 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"testing"
+)
+
+func TestDiffImageManifests(t *testing.T) {
+	tests := []struct {
+		a        string
+		b        string
+		expected []string
+	}{
+		// Identical manifests
+		{
+			`{"acKind": "ImageManifest", "acVersion": "0.8.11", "name": "example.com/app"}`,
+			`{"acKind": "ImageManifest", "acVersion": "0.8.11", "name": "example.com/app"}`,
+			nil,
+		},
+		// Reordered labels, annotations and isolators are not a change
+		{
+			`{"acKind": "ImageManifest", "acVersion": "0.8.11", "name": "example.com/app",
+			  "labels": [{"name": "version", "value": "1.0.0"}, {"name": "os", "value": "linux"}],
+			  "annotations": [{"name": "a", "value": "1"}, {"name": "b", "value": "2"}],
+			  "app": {"exec": ["/app"], "user": "0", "group": "0", "isolators": [
+			    {"name": "resource/memory", "value": {"limit": "1G"}},
+			    {"name": "resource/cpu", "value": {"limit": "1"}}]}}`,
+			`{"acKind": "ImageManifest", "acVersion": "0.8.11", "name": "example.com/app",
+			  "labels": [{"name": "os", "value": "linux"}, {"name": "version", "value": "1.0.0"}],
+			  "annotations": [{"name": "b", "value": "2"}, {"name": "a", "value": "1"}],
+			  "app": {"exec": ["/app"], "user": "0", "group": "0", "isolators": [
+			    {"name": "resource/cpu", "value": { "limit": "1" }},
+			    {"name": "resource/memory", "value": {"limit": "1G"}}]}}`,
+			nil,
+		},
+		// Labels
+		{
+			`{"acKind": "ImageManifest", "acVersion": "0.8.11", "name": "example.com/app",
+			  "labels": [{"name": "version", "value": "1.0.0"}, {"name": "os", "value": "linux"}]}`,
+			`{"acKind": "ImageManifest", "acVersion": "0.8.11", "name": "example.com/app",
+			  "labels": [{"name": "version", "value": "1.1.0"}, {"name": "arch", "value": "amd64"}]}`,
+			[]string{
+				`+ labels[arch]: "amd64"`,
+				`- labels[os]: "linux"`,
+				`~ labels[version]: "1.0.0" -> "1.1.0"`,
+			},
+		},
+		// App fields
+		{
+			`{"acKind": "ImageManifest", "acVersion": "0.8.11", "name": "example.com/app",
+			  "app": {"exec": ["/app"], "user": "0", "group": "0",
+			    "environment": [{"name": "A", "value": "1"}],
+			    "ports": [{"name": "http", "protocol": "tcp", "port": 80}],
+			    "isolators": [{"name": "resource/memory", "value": {"limit": "1G"}}]}}`,
+			`{"acKind": "ImageManifest", "acVersion": "0.8.11", "name": "example.com/app",
+			  "app": {"exec": ["/app", "--debug"], "user": "0", "group": "0",
+			    "environment": [{"name": "A", "value": "2"}],
+			    "ports": [{"name": "http", "protocol": "tcp", "port": 8080}],
+			    "isolators": [{"name": "resource/memory", "value": {"limit": "2G"}}]}}`,
+			[]string{
+				`~ app.exec: ["/app"] -> ["/app","--debug"]`,
+				`~ app.environment[A]: "1" -> "2"`,
+				`~ app.ports[http]: {"name":"http","protocol":"tcp","port":80,"count":1,"socketActivated":false} -> {"name":"http","protocol":"tcp","port":8080,"count":1,"socketActivated":false}`,
+				`~ app.isolators[resource/memory]: {"limit":"1G"} -> {"limit":"2G"}`,
+			},
+		},
+		// App added
+		{
+			`{"acKind": "ImageManifest", "acVersion": "0.8.11", "name": "example.com/app"}`,
+			`{"acKind": "ImageManifest", "acVersion": "0.8.11", "name": "example.com/app",
+			  "app": {"exec": ["/app"], "user": "0", "group": "0"}}`,
+			[]string{
+				`+ app: {"exec":["/app"],"user":"0","group":"0"}`,
+			},
+		},
+		// Dependencies, including their order
+		{
+			`{"acKind": "ImageManifest", "acVersion": "0.8.11", "name": "example.com/app",
+			  "dependencies": [{"imageName": "example.com/a"}, {"imageName": "example.com/b"}, {"imageName": "example.com/c"}]}`,
+			`{"acKind": "ImageManifest", "acVersion": "0.8.11", "name": "example.com/app",
+			  "dependencies": [{"imageName": "example.com/b"}, {"imageName": "example.com/a", "size": 10}]}`,
+			[]string{
+				`~ dependencies[example.com/a]: {"imageName":"example.com/a"} -> {"imageName":"example.com/a","size":10}`,
+				`- dependencies[example.com/c]: {"imageName":"example.com/c"}`,
+				`~ dependencies.order: ["example.com/a","example.com/b"] -> ["example.com/b","example.com/a"]`,
+			},
+		},
+		// Path whitelist
+		{
+			`{"acKind": "ImageManifest", "acVersion": "0.8.11", "name": "example.com/app",
+			  "pathWhitelist": ["/a", "/b"]}`,
+			`{"acKind": "ImageManifest", "acVersion": "0.8.11", "name": "example.com/app",
+			  "pathWhitelist": ["/b", "/c"]}`,
+			[]string{
+				`- pathWhitelist[/a]: "/a"`,
+				`+ pathWhitelist[/c]: "/c"`,
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		var a, b ImageManifest
+		if err := a.UnmarshalJSON([]byte(tt.a)); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if err := b.UnmarshalJSON([]byte(tt.b)); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		checkDiff(t, i, DiffImageManifests(&a, &b), tt.expected)
+	}
+}
+
+func TestDiffPodManifests(t *testing.T) {
+	tests := []struct {
+		a        string
+		b        string
+		expected []string
+	}{
+		// Identical manifests
+		{
+			`{"acKind": "PodManifest", "acVersion": "0.8.11", "apps": [
+			  {"name": "app", "image": {"id": "sha512-aaaa"}}]}`,
+			`{"acKind": "PodManifest", "acVersion": "0.8.11", "apps": [
+			  {"name": "app", "image": {"id": "sha512-aaaa"}}]}`,
+			nil,
+		},
+		// Apps are matched by name
+		{
+			`{"acKind": "PodManifest", "acVersion": "0.8.11", "apps": [
+			  {"name": "app", "image": {"id": "sha512-aaaa"}},
+			  {"name": "old", "image": {"id": "sha512-bbbb"}}]}`,
+			`{"acKind": "PodManifest", "acVersion": "0.8.11", "apps": [
+			  {"name": "new", "image": {"id": "sha512-bbbb"}},
+			  {"name": "app", "image": {"id": "sha512-cccc"}, "readOnlyRootFS": true,
+			   "mounts": [{"volume": "data", "path": "/data"}]}]}`,
+			[]string{
+				`~ apps[app].image.id: "sha512-aaaa" -> "sha512-cccc"`,
+				`~ apps[app].readOnlyRootFS: false -> true`,
+				`+ apps[app].mounts[/data]: {"volume":"data","path":"/data"}`,
+				`+ apps[new]: {"name":"new","image":{"id":"sha512-bbbb"}}`,
+				`- apps[old]: {"name":"old","image":{"id":"sha512-bbbb"}}`,
+			},
+		},
+		// Pod level fields
+		{
+			`{"acKind": "PodManifest", "acVersion": "0.8.11", "apps": [],
+			  "isolators": [{"name": "resource/memory", "value": {"limit": "4G"}}],
+			  "annotations": [{"name": "ip-address", "value": "10.1.2.3"}],
+			  "userLabels": {"team": "a"}}`,
+			`{"acKind": "PodManifest", "acVersion": "0.8.11", "apps": [],
+			  "volumes": [{"name": "work", "kind": "host", "source": "/opt/work"}],
+			  "isolators": [{"name": "resource/memory", "value": {"limit": "2G"}}],
+			  "ports": [{"name": "ftp", "hostPort": 2121}],
+			  "userLabels": {"team": "b"}}`,
+			[]string{
+				`+ volumes[work]: {"name":"work","kind":"host","source":"/opt/work"}`,
+				`~ isolators[resource/memory]: {"limit":"4G"} -> {"limit":"2G"}`,
+				`- annotations[ip-address]: "10.1.2.3"`,
+				`+ ports[ftp]: {"name":"ftp","hostPort":2121}`,
+				`~ userLabels[team]: "a" -> "b"`,
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		var a, b PodManifest
+		if err := a.UnmarshalJSON([]byte(tt.a)); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if err := b.UnmarshalJSON([]byte(tt.b)); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		checkDiff(t, i, DiffPodManifests(&a, &b), tt.expected)
+	}
+}
+
+func checkDiff(t *testing.T, i int, diff ManifestDiff, expected []string) {
+	if len(diff) != len(expected) {
+		t.Errorf("#%d: got %d changes, want %d: %v", i, len(diff), len(expected), diff)
+		return
+	}
+	for j, c := range diff {
+		if c.String() != expected[j] {
+			t.Errorf("#%d: change %d: got %s, want %s", i, j, c.String(), expected[j])
+		}
+	}
+}
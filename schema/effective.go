@@ -0,0 +1,130 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/appc/spec/schema/types"
+)
+
+// EffectiveApp computes the app an executor should run for the given
+// RuntimeApp of a pod, together with the annotations the app must be exposed
+// with through the metadata service.
+//
+// As the app of the RuntimeApp is a substitute for the app of the image
+// manifest, it replaces it wholesale when present; the image app is used
+// otherwise.
+//
+// Pod-level isolators are then applied to the app unless the app already has
+// an isolator of the same name or a conflicting one, and the pod's
+// userAnnotations and userLabels are added for the keys the app does not set.
+//
+// The returned annotations are the image annotations merged with the
+// RuntimeApp annotations, the latter taking precedence. Pod annotations stay
+// scoped to the pod and are not merged.
+//
+// Neither image nor ra are modified.
+func EffectiveApp(image *ImageManifest, ra RuntimeApp, pod PodManifest) (*types.App, types.Annotations, error) {
+	if image == nil {
+		return nil, nil, errors.New("image manifest must be provided")
+	}
+	if image.App == nil && ra.App == nil {
+		return nil, nil, fmt.Errorf("app %q: image %q has no app and none is provided by the pod", ra.Name, image.Name)
+	}
+
+	var app *types.App
+	if ra.App != nil {
+		app = copyApp(ra.App)
+	} else {
+		app = copyApp(image.App)
+	}
+
+	for _, i := range pod.Isolators {
+		if app.Isolators.GetByName(i.Name) != nil || isolatorConflicts(app.Isolators, i) {
+			continue
+		}
+		app.Isolators = append(app.Isolators, i)
+	}
+	app.UserAnnotations = mergeStringMap(pod.UserAnnotations, app.UserAnnotations)
+	app.UserLabels = mergeStringMap(pod.UserLabels, app.UserLabels)
+
+	var annotations types.Annotations
+	for _, a := range image.Annotations {
+		annotations.Set(a.Name, a.Value)
+	}
+	for _, a := range ra.Annotations {
+		annotations.Set(a.Name, a.Value)
+	}
+
+	return app, annotations, nil
+}
+
+// isolatorConflicts returns whether the isolator i conflicts with any of the
+// given isolators, in either direction.
+func isolatorConflicts(isolators types.Isolators, i types.Isolator) bool {
+	var conflicts []types.ACIdentifier
+	if v := i.Value(); v != nil {
+		conflicts = v.Conflicts()
+	}
+	for _, other := range isolators {
+		for _, c := range conflicts {
+			if other.Name == c {
+				return true
+			}
+		}
+		if v := other.Value(); v != nil {
+			for _, c := range v.Conflicts() {
+				if i.Name == c {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// mergeStringMap returns a new map with the entries of base and override,
+// the latter taking precedence. nil is returned if both are empty.
+func mergeStringMap(base, override map[string]string) map[string]string {
+	if len(base) == 0 && len(override) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(base)+len(override))
+	for k, v := range base {
+		m[k] = v
+	}
+	for k, v := range override {
+		m[k] = v
+	}
+	return m
+}
+
+// copyApp returns a copy of the given app that does not share any slice or
+// map with it.
+func copyApp(a *types.App) *types.App {
+	na := *a
+	na.Exec = append(types.Exec(nil), a.Exec...)
+	na.EventHandlers = append([]types.EventHandler(nil), a.EventHandlers...)
+	na.SupplementaryGIDs = append([]int(nil), a.SupplementaryGIDs...)
+	na.Environment = append(types.Environment(nil), a.Environment...)
+	na.MountPoints = append([]types.MountPoint(nil), a.MountPoints...)
+	na.Ports = append([]types.Port(nil), a.Ports...)
+	na.Isolators = append(types.Isolators(nil), a.Isolators...)
+	na.UserAnnotations = mergeStringMap(a.UserAnnotations, nil)
+	na.UserLabels = mergeStringMap(a.UserLabels, nil)
+	return &na
+}
@@ -0,0 +1,238 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+)
+
+func mustApp(t *testing.T, j string) *types.App {
+	if j == "" {
+		return nil
+	}
+	var a types.App
+	if err := json.Unmarshal([]byte(j), &a); err != nil {
+		t.Fatalf("unexpected error unmarshalling app %s: %v", j, err)
+	}
+	return &a
+}
+
+func mustIsolators(t *testing.T, j string) types.Isolators {
+	if j == "" {
+		return nil
+	}
+	var is types.Isolators
+	if err := json.Unmarshal([]byte(j), &is); err != nil {
+		t.Fatalf("unexpected error unmarshalling isolators %s: %v", j, err)
+	}
+	return is
+}
+
+func TestEffectiveApp(t *testing.T) {
+	tests := []struct {
+		imageApp        string
+		imageAnnos      types.Annotations
+		runtimeApp      string
+		runtimeAnnos    types.Annotations
+		podIsolators    string
+		podUserLabels   types.UserLabels
+		podUserAnnos    types.UserAnnotations
+		podAnnos        types.Annotations
+		expectedApp     string
+		expectedAnnos   types.Annotations
+		expectedFailure bool
+	}{
+		// No app anywhere
+		{
+			expectedFailure: true,
+		},
+		// Only the image app
+		{
+			imageApp:    `{"exec": ["/bin/app", "--debug"], "user": "0", "group": "0", "workingDirectory": "/opt"}`,
+			expectedApp: `{"exec": ["/bin/app", "--debug"], "user": "0", "group": "0", "workingDirectory": "/opt"}`,
+		},
+		// Only the runtime app
+		{
+			runtimeApp:  `{"exec": ["/bin/app"], "user": "1000", "group": "1000"}`,
+			expectedApp: `{"exec": ["/bin/app"], "user": "1000", "group": "1000"}`,
+		},
+		// The runtime app replaces the image app wholesale
+		{
+			imageApp:    `{"exec": ["/bin/app", "--debug"], "user": "0", "group": "0", "workingDirectory": "/opt", "supplementaryGIDs": [1, 2]}`,
+			runtimeApp:  `{"user": "1000", "group": "0", "supplementaryGIDs": [3]}`,
+			expectedApp: `{"user": "1000", "group": "0", "supplementaryGIDs": [3]}`,
+		},
+		// Image environment variables, event handlers, mount points, ports
+		// and isolators can be removed by the runtime app
+		{
+			imageApp: `{"exec": ["/bin/app"], "user": "0", "group": "0",
+				"environment": [{"name": "A", "value": "image"}, {"name": "B", "value": "image"}],
+				"eventHandlers": [{"name": "pre-start", "exec": ["/bin/prepare"]}],
+				"mountPoints": [{"name": "data", "path": "/data"}, {"name": "logs", "path": "/var/log"}],
+				"ports": [{"name": "http", "protocol": "tcp", "port": 80}],
+				"isolators": [{"name": "resource/memory", "value": {"limit": "1G"}}],
+				"userLabels": {"a": "image"}}`,
+			runtimeApp: `{"exec": ["/bin/app"], "user": "0", "group": "0",
+				"environment": [{"name": "B", "value": "runtime"}],
+				"mountPoints": [{"name": "data", "path": "/srv/data", "readOnly": true}]}`,
+			expectedApp: `{"exec": ["/bin/app"], "user": "0", "group": "0",
+				"environment": [{"name": "B", "value": "runtime"}],
+				"mountPoints": [{"name": "data", "path": "/srv/data", "readOnly": true}]}`,
+		},
+		// Pod isolators apply to the runtime app, not to the replaced
+		// image isolators
+		{
+			imageApp: `{"exec": ["/bin/app"], "user": "0", "group": "0", "isolators": [
+				{"name": "resource/memory", "value": {"limit": "1G"}}]}`,
+			runtimeApp: `{"exec": ["/bin/app"], "user": "0", "group": "0", "isolators": [
+				{"name": "os/linux/seccomp-retain-set", "value": {"set": ["@appc.io/all"]}}]}`,
+			podIsolators: `[
+				{"name": "resource/memory", "value": {"limit": "4G"}},
+				{"name": "os/linux/seccomp-remove-set", "value": {"set": ["@appc.io/empty"]}}]`,
+			expectedApp: `{"exec": ["/bin/app"], "user": "0", "group": "0", "isolators": [
+				{"name": "os/linux/seccomp-retain-set", "value": {"set": ["@appc.io/all"]}},
+				{"name": "resource/memory", "value": {"limit": "4G"}}]}`,
+		},
+		// Pod isolators apply when the app does not set them
+		{
+			imageApp: `{"exec": ["/bin/app"], "user": "0", "group": "0", "isolators": [
+				{"name": "resource/memory", "value": {"limit": "1G"}},
+				{"name": "os/linux/seccomp-retain-set", "value": {"set": ["@appc.io/all"]}}]}`,
+			podIsolators: `[
+				{"name": "resource/memory", "value": {"limit": "4G"}},
+				{"name": "resource/cpu", "value": {"limit": "2"}},
+				{"name": "os/linux/seccomp-remove-set", "value": {"set": ["@appc.io/empty"]}}]`,
+			expectedApp: `{"exec": ["/bin/app"], "user": "0", "group": "0", "isolators": [
+				{"name": "resource/memory", "value": {"limit": "1G"}},
+				{"name": "os/linux/seccomp-retain-set", "value": {"set": ["@appc.io/all"]}},
+				{"name": "resource/cpu", "value": {"limit": "2"}}]}`,
+		},
+		// User labels and annotations: image app, then pod
+		{
+			imageApp:      `{"exec": ["/bin/app"], "user": "0", "group": "0", "userLabels": {"a": "image", "b": "image"}, "userAnnotations": {"x": "image"}}`,
+			podUserLabels: types.UserLabels{"a": "pod", "c": "pod"},
+			podUserAnnos:  types.UserAnnotations{"x": "pod", "y": "pod"},
+			expectedApp:   `{"exec": ["/bin/app"], "user": "0", "group": "0", "userLabels": {"a": "image", "b": "image", "c": "pod"}, "userAnnotations": {"x": "image", "y": "pod"}}`,
+		},
+		// User labels: runtime app, then pod, the image ones being replaced
+		{
+			imageApp:      `{"exec": ["/bin/app"], "user": "0", "group": "0", "userLabels": {"a": "image", "b": "image"}}`,
+			runtimeApp:    `{"exec": ["/bin/app"], "user": "0", "group": "0", "userLabels": {"b": "runtime"}}`,
+			podUserLabels: types.UserLabels{"a": "pod", "b": "pod"},
+			expectedApp:   `{"exec": ["/bin/app"], "user": "0", "group": "0", "userLabels": {"a": "pod", "b": "runtime"}}`,
+		},
+		// Annotations: runtime app annotations take precedence
+		{
+			imageApp: `{"exec": ["/bin/app"], "user": "0", "group": "0"}`,
+			imageAnnos: types.Annotations{
+				{Name: "authors", Value: "image"},
+				{Name: "foo", Value: "image"},
+			},
+			runtimeAnnos: types.Annotations{
+				{Name: "foo", Value: "runtime"},
+				{Name: "bar", Value: "runtime"},
+			},
+			expectedApp: `{"exec": ["/bin/app"], "user": "0", "group": "0"}`,
+			expectedAnnos: types.Annotations{
+				{Name: "authors", Value: "image"},
+				{Name: "foo", Value: "runtime"},
+				{Name: "bar", Value: "runtime"},
+			},
+		},
+		// Annotations: pod annotations are not app annotations
+		{
+			imageApp: `{"exec": ["/bin/app"], "user": "0", "group": "0"}`,
+			imageAnnos: types.Annotations{
+				{Name: "foo", Value: "image"},
+			},
+			runtimeAnnos: types.Annotations{
+				{Name: "bar", Value: "runtime"},
+			},
+			podAnnos: types.Annotations{
+				{Name: "ip-address", Value: "10.1.2.3"},
+				{Name: "foo", Value: "pod"},
+				{Name: "bar", Value: "pod"},
+			},
+			expectedApp: `{"exec": ["/bin/app"], "user": "0", "group": "0"}`,
+			expectedAnnos: types.Annotations{
+				{Name: "foo", Value: "image"},
+				{Name: "bar", Value: "runtime"},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		im := BlankImageManifest()
+		im.Name = "example.com/app"
+		im.App = mustApp(t, tt.imageApp)
+		im.Annotations = tt.imageAnnos
+		imj, err := im.MarshalJSON()
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+
+		ra := RuntimeApp{
+			Name:        "app",
+			App:         mustApp(t, tt.runtimeApp),
+			Annotations: tt.runtimeAnnos,
+		}
+		pm := BlankPodManifest()
+		pm.Apps = AppList{ra}
+		pm.Isolators = mustIsolators(t, tt.podIsolators)
+		pm.UserLabels = tt.podUserLabels
+		pm.UserAnnotations = tt.podUserAnnos
+		pm.Annotations = tt.podAnnos
+
+		app, annos, err := EffectiveApp(im, ra, *pm)
+		if tt.expectedFailure {
+			if err == nil {
+				t.Errorf("#%d: expected failure, got nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+
+		got, err := json.Marshal(app)
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		want, err := json.Marshal(mustApp(t, tt.expectedApp))
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if string(got) != string(want) {
+			t.Errorf("#%d: got app %s, want %s", i, got, want)
+		}
+		if !reflect.DeepEqual(annos, tt.expectedAnnos) {
+			t.Errorf("#%d: got annotations %v, want %v", i, annos, tt.expectedAnnos)
+		}
+
+		// The image manifest must not be modified
+		nimj, err := im.MarshalJSON()
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if string(imj) != string(nimj) {
+			t.Errorf("#%d: image manifest modified: got %s, want %s", i, nimj, imj)
+		}
+	}
+}
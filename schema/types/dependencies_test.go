@@ -14,7 +14,10 @@
 
 package types
 
-import "testing"
+import (
+	"fmt"
+	"testing"
+)
 
 func TestEmptyHash(t *testing.T) {
 	dj := `{"imageName": "example.com/reduce-worker-base"}`
@@ -38,3 +41,22 @@ func TestEmptyHash(t *testing.T) {
 		t.Fatalf("unexpected error: %v", err)
 	}
 }
+
+// Version labels are not validated as constraints, which would reject
+// valid plain versions.
+func TestDependencyVersionConstraint(t *testing.T) {
+	for i, v := range []string{
+		"1.0.0",
+		">=1.2.0, <2.0.0",
+		"~1.4",
+		"2.0~rc1",
+		"1.0+git,abc",
+		">=1.2.0,",
+	} {
+		dj := fmt.Sprintf(`{"imageName": "example.com/a", "labels": [{"name": "version", "value": %q}]}`, v)
+		var d Dependency
+		if err := d.UnmarshalJSON([]byte(dj)); err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-semver/semver"
+)
+
+// versionOperators are the operators of a version condition. Longer
+// operators come first so that they are matched before their prefixes.
+var versionOperators = []string{">=", "<=", "!=", ">", "<", "=", "~", "^"}
+
+// A VersionConstraint is a list of conditions a semantic version must all
+// meet, written as a comma separated list of conditions, e.g.
+// ">=1.2.0, <2.0.0". A condition is an operator followed by a version:
+//
+//   - "=", "!=", ">", ">=", "<" and "<=" compare versions;
+//   - "~" accepts the versions with the same major and minor versions
+//     (or only the same major version if the minor version is omitted)
+//     which are not lower, e.g. "~1.4" means ">=1.4.0, <1.5.0";
+//   - "^" accepts the versions with the same leftmost non-zero number
+//     which are not lower, e.g. "^1.2.3" means ">=1.2.3, <2.0.0" and
+//     "^0.2.3" means ">=0.2.3, <0.3.0".
+//
+// The minor and patch versions may be omitted, they default to 0.
+type VersionConstraint struct {
+	conds []versionCondition
+}
+
+type versionCondition struct {
+	op      string
+	version semver.Version
+	// parts is the number of numbers given in the version, used by "~"
+	// and "^".
+	parts int
+}
+
+// IsVersionConstraint returns whether the given string is meant to be a
+// version constraint rather than a version, that is whether it starts with
+// an operator. Other strings, e.g. "2.0~rc1", are plain versions.
+func IsVersionConstraint(s string) bool {
+	s = strings.TrimSpace(s)
+	for _, o := range versionOperators {
+		if strings.HasPrefix(s, o) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewVersionConstraint parses the given version constraint.
+func NewVersionConstraint(s string) (*VersionConstraint, error) {
+	vc := &VersionConstraint{}
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			return nil, fmt.Errorf("bad version constraint %q: empty condition", s)
+		}
+		cond, err := newVersionCondition(c)
+		if err != nil {
+			return nil, fmt.Errorf("bad version constraint %q: %v", s, err)
+		}
+		vc.conds = append(vc.conds, *cond)
+	}
+	return vc, nil
+}
+
+func newVersionCondition(s string) (*versionCondition, error) {
+	op := ""
+	for _, o := range versionOperators {
+		if strings.HasPrefix(s, o) {
+			op = o
+			break
+		}
+	}
+	if op == "" {
+		return nil, fmt.Errorf("missing operator in %q", s)
+	}
+	v, parts, err := parsePartialVersion(strings.TrimSpace(s[len(op):]))
+	if err != nil {
+		return nil, err
+	}
+	return &versionCondition{op: op, version: *v, parts: parts}, nil
+}
+
+// parsePartialVersion parses a semantic version whose minor and patch
+// versions may be omitted, and returns the number of numbers given.
+func parsePartialVersion(s string) (*semver.Version, int, error) {
+	if v, err := semver.NewVersion(s); err == nil {
+		return v, 3, nil
+	}
+	nums := strings.Split(s, ".")
+	if len(nums) > 2 {
+		return nil, 0, fmt.Errorf("bad version %q", s)
+	}
+	var v semver.Version
+	for i, n := range nums {
+		x, err := strconv.ParseInt(n, 10, 64)
+		if err != nil || x < 0 {
+			return nil, 0, fmt.Errorf("bad version %q", s)
+		}
+		if i == 0 {
+			v.Major = x
+		} else {
+			v.Minor = x
+		}
+	}
+	return &v, len(nums), nil
+}
+
+// Check returns whether the version meets all the conditions.
+func (vc VersionConstraint) Check(v SemVer) bool {
+	for _, c := range vc.conds {
+		if !c.check(semver.Version(v)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (vc VersionConstraint) String() string {
+	conds := make([]string, len(vc.conds))
+	for i, c := range vc.conds {
+		conds[i] = c.op + c.version.String()
+	}
+	return strings.Join(conds, ", ")
+}
+
+func (c versionCondition) check(v semver.Version) bool {
+	cmp := compareVersions(v, c.version)
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case "~":
+		return cmp >= 0 && v.LessThan(c.tildeBound())
+	case "^":
+		return cmp >= 0 && v.LessThan(c.caretBound())
+	}
+	return false
+}
+
+// tildeBound returns the lowest version not accepted by a "~" condition.
+func (c versionCondition) tildeBound() semver.Version {
+	if c.parts == 1 {
+		return semver.Version{Major: c.version.Major + 1}
+	}
+	return semver.Version{Major: c.version.Major, Minor: c.version.Minor + 1}
+}
+
+// caretBound returns the lowest version not accepted by a "^" condition.
+func (c versionCondition) caretBound() semver.Version {
+	v := c.version
+	switch {
+	case v.Major != 0 || c.parts == 1:
+		return semver.Version{Major: v.Major + 1}
+	case v.Minor != 0 || c.parts == 2:
+		return semver.Version{Minor: v.Minor + 1}
+	}
+	return semver.Version{Patch: v.Patch + 1}
+}
+
+func compareVersions(a, b semver.Version) int {
+	switch {
+	case a.LessThan(b):
+		return -1
+	case b.LessThan(a):
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,130 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import "testing"
+
+func TestVersionConstraint(t *testing.T) {
+	tests := []struct {
+		c    string
+		in   []string
+		out  []string
+		werr bool
+	}{
+		{
+			c:   ">=1.2.0, <2.0.0",
+			in:  []string{"1.2.0", "1.9.9", "1.10.0"},
+			out: []string{"1.1.9", "2.0.0", "3.0.0"},
+		},
+		{
+			c:   "~1.4",
+			in:  []string{"1.4.0", "1.4.7"},
+			out: []string{"1.3.9", "1.5.0", "2.0.0"},
+		},
+		{
+			c:   "~1.4.2",
+			in:  []string{"1.4.2", "1.4.9"},
+			out: []string{"1.4.1", "1.5.0"},
+		},
+		{
+			c:   "~1",
+			in:  []string{"1.0.0", "1.9.0"},
+			out: []string{"0.9.0", "2.0.0"},
+		},
+		{
+			c:   "^1.2.3",
+			in:  []string{"1.2.3", "1.9.0"},
+			out: []string{"1.2.2", "2.0.0"},
+		},
+		{
+			c:   "^0.2.3",
+			in:  []string{"0.2.3", "0.2.9"},
+			out: []string{"0.3.0", "1.0.0"},
+		},
+		{
+			c:   "^0.0.3",
+			in:  []string{"0.0.3"},
+			out: []string{"0.0.4"},
+		},
+		{
+			c:   "=1.2, !=1.3.0",
+			in:  []string{"1.2.0"},
+			out: []string{"1.2.1", "1.3.0"},
+		},
+		{
+			c:   "> 1.0.0, <= 1.1",
+			in:  []string{"1.0.1", "1.1.0"},
+			out: []string{"1.0.0", "1.1.1"},
+		},
+		{
+			c:   "<1.0.0",
+			in:  []string{"0.9.0", "1.0.0-alpha"},
+			out: []string{"1.0.0"},
+		},
+		{c: "1.2.0", werr: true},
+		{c: ">=1.2.0,", werr: true},
+		{c: ">=", werr: true},
+		{c: "~1.x", werr: true},
+		{c: ">=1.2.3.4", werr: true},
+	}
+	for i, tt := range tests {
+		vc, err := NewVersionConstraint(tt.c)
+		if gerr := err != nil; gerr != tt.werr {
+			t.Errorf("#%d: gerr=%t, want %t (err=%v)", i, gerr, tt.werr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		for _, v := range tt.in {
+			if !vc.Check(*mustSemVer(t, v)) {
+				t.Errorf("#%d: %s should satisfy %q", i, v, tt.c)
+			}
+		}
+		for _, v := range tt.out {
+			if vc.Check(*mustSemVer(t, v)) {
+				t.Errorf("#%d: %s should not satisfy %q", i, v, tt.c)
+			}
+		}
+	}
+}
+
+func TestIsVersionConstraint(t *testing.T) {
+	tests := []struct {
+		s string
+		w bool
+	}{
+		{"1.2.0", false},
+		{"latest", false},
+		{"2.0~rc1", false},
+		{"1.0+git,abc", false},
+		{"~1.4", true},
+		{">=1.2.0, <2.0.0", true},
+		{" ^1.2", true},
+	}
+	for i, tt := range tests {
+		if g := IsVersionConstraint(tt.s); g != tt.w {
+			t.Errorf("#%d: got %t, want %t", i, g, tt.w)
+		}
+	}
+}
+
+func mustSemVer(t *testing.T, s string) *SemVer {
+	v, err := NewSemVer(s)
+	if err != nil {
+		t.Fatalf("bad version %q: %v", s, err)
+	}
+	return v
+}
@@ -16,7 +16,7 @@ COVER=${COVER:-"-cover"}
 
 source ./build.sh
 
-TESTABLE_AND_FORMATTABLE="aci discovery pkg/acirenderer pkg/tarheader schema schema/lastditch schema/types"
+TESTABLE_AND_FORMATTABLE="aci discovery pkg/acirenderer pkg/acistore pkg/tarheader schema schema/lastditch schema/types"
 FORMATTABLE="$TESTABLE_AND_FORMATTABLE ace actool"
 
 # user has not provided PKG override